@@ -0,0 +1,180 @@
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// fileAck 跟踪一个文件发送的所有事件, 全部被 output 确认后才执行 after_collect
+type fileAck struct {
+	c        *collector
+	dir      string
+	filename string
+
+	// 发送时文件的大小和修改时间, 执行动作前确认文件没有再被修改
+	size    int64
+	modTime time.Time
+	// 文件在 registrar 中的状态, 重新采集之后就不是同一个了
+	state *fileState
+
+	pending int32
+	// 没有全部发送, 被丢弃的事件也会被确认, 不能执行 after_collect
+	aborted int32
+}
+
+// publishFile 发送一个文件的所有事件, 被 Stop 打断时返回 false
+func (bt *lsbeat) publishFile(c *collector, dir string, info os.FileInfo, state *fileState, events []beat.Event) bool {
+	fullPath := filepath.Join(dir, info.Name())
+	if c.config.AfterCollect.Action == afterCollectNone {
+		if !publishEvents(c.client, events) {
+			logp.Info("%s collector: stopped while sending %s, it will be collected again", c.name, fullPath)
+			return false
+		}
+		filesCollected.Inc()
+		return true
+	}
+
+	// 记录到 registrar 中, 确认之前退出的话下次启动时重新发送
+	state.AfterCollect = afterCollectSent
+	f := &fileAck{
+		c:        c,
+		dir:      dir,
+		filename: info.Name(),
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		state:    state,
+		pending:  int32(len(events)),
+	}
+	if len(events) == 0 {
+		// 没有需要确认的事件
+		filesCollected.Inc()
+		bt.fileACKed(f)
+		return true
+	}
+	for i := range events {
+		events[i].Private = f
+	}
+	if !publishEvents(c.client, events) {
+		atomic.StoreInt32(&f.aborted, 1)
+		logp.Info("%s collector: stopped while sending %s, it will be collected again", c.name, fullPath)
+		return false
+	}
+	filesCollected.Inc()
+	return true
+}
+
+// onACK 在 publisher pipeline 的 goroutine 中被调用
+func (bt *lsbeat) onACK(acked int, data []interface{}) {
+	for _, d := range data {
+		f, ok := d.(*fileAck)
+		if !ok {
+			continue
+		}
+		if atomic.AddInt32(&f.pending, -1) == 0 && atomic.LoadInt32(&f.aborted) == 0 {
+			bt.fileACKed(f)
+		}
+	}
+}
+
+// 记录下所有事件都已被确认的文件, 在下一轮开始时由 Run 执行 after_collect
+func (bt *lsbeat) fileACKed(f *fileAck) {
+	bt.ackMu.Lock()
+	bt.acked = append(bt.acked, f)
+	bt.ackMu.Unlock()
+}
+
+func (bt *lsbeat) takeACKed() []*fileAck {
+	bt.ackMu.Lock()
+	defer bt.ackMu.Unlock()
+	acked := bt.acked
+	bt.acked = nil
+	return acked
+}
+
+// pendingEvents 记录已经发送但还没有被确认的事件数
+type pendingEvents struct {
+	mu sync.Mutex
+	n  int
+	// 有事件被确认时通知 wait
+	changed chan struct{}
+}
+
+func (p *pendingEvents) add(n int) {
+	p.mu.Lock()
+	p.n += n
+	p.mu.Unlock()
+}
+
+// acked 在 publisher pipeline 的 goroutine 中被调用, 包括被 processor 丢弃的事件
+func (p *pendingEvents) acked(n int) {
+	p.mu.Lock()
+	p.n -= n
+	if p.changed == nil {
+		p.changed = make(chan struct{}, 1)
+	}
+	p.mu.Unlock()
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待所有事件被确认, done 或 timeout 先到时返回还没有确认的事件数
+func (p *pendingEvents) wait(done <-chan struct{}, timeout <-chan time.Time) int {
+	for {
+		p.mu.Lock()
+		n := p.n
+		if p.changed == nil {
+			p.changed = make(chan struct{}, 1)
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		if n <= 0 {
+			return 0
+		}
+
+		select {
+		case <-changed:
+		case <-done:
+			return n
+		case <-timeout:
+			return n
+		}
+	}
+}
+
+// countingClient 在发送时计数, 和 acker.Counting 一起用于等待事件被确认
+type countingClient struct {
+	beat.Client
+	pending *pendingEvents
+}
+
+func (c *countingClient) Publish(event beat.Event) {
+	c.pending.add(1)
+	c.Client.Publish(event)
+}
+
+func (c *countingClient) PublishAll(events []beat.Event) {
+	c.pending.add(len(events))
+	c.Client.PublishAll(events)
+}
+
+// waitACKs 只采集一遍时在关闭前等待所有事件被确认.
+// 和 filebeat 的 --once 一样, lsbeat 被停止时不再等待, 设置了 shutdown_timeout 时最多等待这么久.
+func (bt *lsbeat) waitACKs() {
+	var timeout <-chan time.Time
+	if bt.config.ShutdownTimeout > 0 {
+		timer := time.NewTimer(bt.config.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if n := bt.pending.wait(bt.ctx.Done(), timeout); n > 0 {
+		logp.Warn("%d events are not acknowledged", n)
+	}
+}
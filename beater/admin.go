@@ -0,0 +1,304 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/paths"
+)
+
+// 运行中的 lsbeat 持有 data 目录下的这个锁, 见 libbeat 的 instance.locker
+const dataLockName = "lsbeat.lock"
+
+// RegistrarEntry 是 registrar 中的一个文件, 用于命令行工具的输出以及导入导出
+type RegistrarEntry struct {
+	Collector string `json:"collector"`
+	Path      string `json:"path"`
+	fileState
+}
+
+// Status 简单说明文件当前的状态, 方便查找文件为什么没有被发送
+func (e RegistrarEntry) Status() string {
+	switch {
+	case e.Quarantined != nil:
+		return "quarantined since " + e.Quarantined.Format(time.RFC3339)
+	case e.NextRetry != nil:
+		return fmt.Sprintf("failed %d times, next retry at %s", e.Failures, e.NextRetry.Format(time.RFC3339))
+	case e.Skipped != "":
+		return "skipped (" + e.Skipped + ")"
+	}
+	return "collected"
+}
+
+// RegistrarStats 是一个采集器的 registrar 的统计
+type RegistrarStats struct {
+	Collector   string
+	Path        string
+	Directories int
+	Files       int
+	Skipped     int
+	Failing     int
+	Quarantined int
+	Oldest      time.Time
+	Newest      time.Time
+}
+
+// ListRegistrar 列出 registrar 中的文件, name 为采集器的名字, name 和 prefix 为空时不过滤
+func ListRegistrar(cfg *common.Config, name, prefix string) ([]RegistrarEntry, error) {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []RegistrarEntry
+	files, err := registrarFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range files {
+		if name != "" && r.collector != name {
+			continue
+		}
+		m, err := loadRegistrarFile(r)
+		if err != nil {
+			return nil, err
+		}
+		for dir, states := range m {
+			for filename, state := range states {
+				path := filepath.Join(dir, filename)
+				if !strings.HasPrefix(path, prefix) {
+					continue
+				}
+				entries = append(entries, RegistrarEntry{Collector: r.collector, Path: path, fileState: *state})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path == entries[j].Path {
+			return entries[i].Collector < entries[j].Collector
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// GetRegistrarStats 统计各个采集器的 registrar
+func GetRegistrarStats(cfg *common.Config) ([]RegistrarStats, error) {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []RegistrarStats
+	files, err := registrarFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range files {
+		m, err := loadRegistrarFile(r)
+		if err != nil {
+			return nil, err
+		}
+		s := RegistrarStats{Collector: r.collector, Path: r.path, Directories: len(m)}
+		for _, states := range m {
+			for _, state := range states {
+				s.Files++
+				switch {
+				case state.Quarantined != nil:
+					s.Quarantined++
+				case state.NextRetry != nil:
+					s.Failing++
+				case state.Skipped != "":
+					s.Skipped++
+				}
+				if state.CollectedTime.IsZero() {
+					continue
+				}
+				if s.Oldest.IsZero() || state.CollectedTime.Before(s.Oldest) {
+					s.Oldest = state.CollectedTime
+				}
+				if state.CollectedTime.After(s.Newest) {
+					s.Newest = state.CollectedTime
+				}
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// ForgetRegistrar 删除匹配的文件, 它们会在下一轮被重新采集.
+// pattern 可以是文件的完整路径, 文件所在的目录或者 glob.
+func ForgetRegistrar(cfg *common.Config, name string, patterns []string) (int, error) {
+	match := func(dir, filename string) bool {
+		path := filepath.Join(dir, filename)
+		for _, p := range patterns {
+			p = filepath.Clean(p)
+			if p == path || p == dir {
+				return true
+			}
+			if ok, _ := filepath.Match(p, path); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	forgotten := 0
+	err := modifyRegistrar(cfg, name, func(c *collector, m map[string]map[string]*fileState) bool {
+		modified := false
+		for dir, states := range m {
+			for filename := range states {
+				if !match(dir, filename) {
+					continue
+				}
+				delete(states, filename)
+				c.removeSnapshot(filepath.Join(dir, filename))
+				modified = true
+				forgotten++
+			}
+			if len(states) == 0 {
+				delete(m, dir)
+			}
+		}
+		return modified
+	})
+	return forgotten, err
+}
+
+// ResetRegistrar 清空 registrar 和快照, 所有文件都会被重新采集
+func ResetRegistrar(cfg *common.Config, name string) (int, error) {
+	removed := 0
+	err := modifyRegistrar(cfg, name, func(c *collector, m map[string]map[string]*fileState) bool {
+		for dir, states := range m {
+			removed += len(states)
+			delete(m, dir)
+		}
+		os.RemoveAll(filepath.Join(filepath.Dir(c.registrarFile.path), "snapshots", c.name))
+		return true
+	})
+	return removed, err
+}
+
+// ExportRegistrar 以 JSON 数组的形式输出所有的文件
+func ExportRegistrar(cfg *common.Config, name string, w io.Writer) error {
+	entries, err := ListRegistrar(cfg, name, "")
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []RegistrarEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// ImportRegistrar 导入 ExportRegistrar 输出的文件, replace 为 true 时先清空 registrar
+func ImportRegistrar(cfg *common.Config, name string, r io.Reader, replace bool) (int, error) {
+	var entries []RegistrarEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("invalid registrar export: %v", err)
+	}
+
+	imported := 0
+	err := modifyRegistrar(cfg, name, func(c *collector, m map[string]map[string]*fileState) bool {
+		if replace {
+			for dir := range m {
+				delete(m, dir)
+			}
+		}
+		for _, e := range entries {
+			if e.Collector != c.name {
+				continue
+			}
+			state := e.fileState
+			c.setState(filepath.Dir(e.Path), filepath.Base(e.Path), &state)
+			imported++
+		}
+		return true
+	})
+	return imported, err
+}
+
+// modifyRegistrar 在 lsbeat 没有运行时修改 registrar, fn 返回是否有改动
+func modifyRegistrar(cfg *common.Config, name string, fn func(c *collector, m map[string]map[string]*fileState) bool) error {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := registrarFiles(c)
+	if err != nil {
+		return err
+	}
+	for _, r := range files {
+		if name != "" && r.collector != name {
+			continue
+		}
+		if err := modifyRegistrarFile(r, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func modifyRegistrarFile(r registrarFile, fn func(c *collector, m map[string]map[string]*fileState) bool) error {
+	// 两个 lsbeat 的 path.data 不同时, 只锁定 path.data 是不够的
+	lock, err := lockRegistrarDir(filepath.Dir(r.path))
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	backend, err := r.open()
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+
+	m, err := backend.load()
+	if err != nil {
+		return fmt.Errorf("can not load registrar %s: %v", r.path, err)
+	}
+	// 只用到名字和 registrar 的位置, 用于定位快照
+	c := &collector{name: r.collector, registrarFile: r, registrar: m}
+	if !fn(c, m) {
+		return nil
+	}
+	if err := backend.save(m); err != nil {
+		return fmt.Errorf("can not save registrar %s: %v", r.path, err)
+	}
+	return nil
+}
+
+// lockData 获取运行中的 lsbeat 持有的锁, 获取失败说明 lsbeat 正在运行
+func lockData() (func(), error) {
+	fl := flock.New(paths.Resolve(paths.Data, dataLockName))
+	locked, err := fl.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock data path: %v", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("lsbeat is running (%s is locked), stop it before modifying the registrar", fl.Path())
+	}
+	return func() {
+		fl.Unlock()
+		os.Remove(fl.Path())
+	}, nil
+}
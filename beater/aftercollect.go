@@ -0,0 +1,206 @@
+package beater
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// after_collect.action 的取值
+const (
+	afterCollectNone   = "none"
+	afterCollectDelete = "delete"
+	afterCollectMove   = "move"
+	afterCollectRename = "rename"
+)
+
+// fileState.AfterCollect 的取值
+const (
+	afterCollectSent  = "sent"
+	afterCollectACKed = "acked"
+)
+
+func checkAfterCollect(c config.AfterCollectConfig) error {
+	switch c.Action {
+	case afterCollectNone, afterCollectDelete:
+	case afterCollectMove:
+		if c.MoveTo == "" {
+			return fmt.Errorf("after_collect.move_to is required for the move action")
+		}
+	case afterCollectRename:
+		if c.RenameSuffix == "" {
+			return fmt.Errorf("after_collect.rename_suffix is required for the rename action")
+		}
+	default:
+		return fmt.Errorf("unsupported after_collect.action '%s'", c.Action)
+	}
+	return nil
+}
+
+// runAfterCollect 对所有事件都已被确认的文件执行 after_collect 动作.
+// 处理过的文件不会再出现在目录中, 因此从 registrar 中移除.
+func (bt *lsbeat) runAfterCollect() {
+	modified := map[*collector]bool{}
+	for _, f := range bt.takeACKed() {
+		fullPath := filepath.Join(f.dir, f.filename)
+		if atomic.LoadInt32(&f.aborted) != 0 {
+			// 被 Stop 打断, 文件已经回滚, 下次重新采集
+			continue
+		}
+		if f.c.closed {
+			// 采集器已经被 reloader 停止, 它的 registrar 已经关闭
+			logp.Warn("%s collector: stopped before after_collect of %s", f.c.name, fullPath)
+			continue
+		}
+		if f.state != nil && f.c.state(f.dir, f.filename) == f.state && f.state.AfterCollect != afterCollectACKed {
+			// 动作失败或者退出时没有执行的话, 下次启动时不用重新发送
+			f.state.AfterCollect = afterCollectACKed
+			modified[f.c] = true
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			logp.Warn("%s collector: file %s disappeared before after_collect: %v", f.c.name, fullPath, err)
+			continue
+		}
+		if info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+			// 确认之前又被修改了, 等下一次采集
+			logp.Info("%s collector: file %s modified since it was sent, skip after_collect", f.c.name, fullPath)
+			continue
+		}
+
+		if err := bt.afterCollect(f.c, fullPath); err != nil {
+			logp.Err("%s collector: after_collect %s %s failed: %v", f.c.name, f.c.config.AfterCollect.Action, fullPath, err)
+			continue
+		}
+
+		if files, ok := f.c.registrar[f.dir]; ok {
+			delete(files, f.filename)
+			if len(files) == 0 {
+				delete(f.c.registrar, f.dir)
+			}
+		}
+		f.c.removeSnapshot(fullPath)
+		modified[f.c] = true
+	}
+
+	for c := range modified {
+		bt.saveRegistrar(c)
+	}
+}
+
+// resumeAfterCollect 恢复上次退出时没有完成的 after_collect:
+// 没有被确认的文件重新发送, 已经被确认的文件在下一轮开始时执行动作
+func (bt *lsbeat) resumeAfterCollect(c *collector) {
+	if c.config.AfterCollect.Action == afterCollectNone {
+		return
+	}
+	var acked []*fileAck
+	for dir, files := range c.registrar {
+		for filename, state := range files {
+			switch state.AfterCollect {
+			case afterCollectSent:
+				state.resend = true
+			case afterCollectACKed:
+				acked = append(acked, &fileAck{
+					c:        c,
+					dir:      dir,
+					filename: filename,
+					size:     state.Size,
+					modTime:  state.ModTime,
+					state:    state,
+				})
+			}
+		}
+	}
+	for _, f := range acked {
+		bt.fileACKed(f)
+	}
+}
+
+func (bt *lsbeat) afterCollect(c *collector, fullPath string) error {
+	ac := c.config.AfterCollect
+	switch ac.Action {
+	case afterCollectDelete:
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+		// 标记文件也一起删除
+		if c.config.DoneSuffix != "" {
+			os.Remove(fullPath + c.config.DoneSuffix)
+		}
+		logp.Debug("lsbeat", "deleted %s", fullPath)
+
+	case afterCollectMove:
+		// 保持文件相对于根目录的结构
+		_, rel, ok := relativeToRoot(c.paths, fullPath)
+		if !ok {
+			rel = filepath.Base(fullPath)
+		}
+		target := filepath.Join(ac.MoveTo, rel)
+		if err := moveFile(fullPath, target); err != nil {
+			return err
+		}
+		if c.config.DoneSuffix != "" {
+			moveFile(fullPath+c.config.DoneSuffix, target+c.config.DoneSuffix)
+		}
+		logp.Debug("lsbeat", "moved %s to %s", fullPath, target)
+
+	case afterCollectRename:
+		if err := os.Rename(fullPath, fullPath+ac.RenameSuffix); err != nil {
+			return err
+		}
+		logp.Debug("lsbeat", "renamed %s to %s", fullPath, fullPath+ac.RenameSuffix)
+	}
+	return nil
+}
+
+// moveFile 移动文件, 跨文件系统时复制后再删除
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	return copyAndRemove(src, dst)
+}
+
+// copyAndRemove 先复制到临时文件再重命名, 目标文件不会只有一部分内容
+func copyAndRemove(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
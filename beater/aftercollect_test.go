@@ -0,0 +1,206 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func writeFile(t *testing.T, path, content string) os.FileInfo {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, move := range map[string]func(src, dst string) error{
+		"rename": moveFile,
+		// 跨文件系统时 rename 失败, 复制后再删除
+		"copy": func(src, dst string) error {
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			return copyAndRemove(src, dst)
+		},
+	} {
+		src := filepath.Join(dir, name, "a", "list", "1.list")
+		dst := filepath.Join(dir, name, "archive", "a", "list", "1.list")
+		writeFile(t, src, "content")
+
+		if err := move(src, dst); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("%s: source not removed: %v", name, err)
+		}
+		if b, err := os.ReadFile(dst); err != nil || string(b) != "content" {
+			t.Errorf("%s: target = %q, %v", name, b, err)
+		}
+		if info, err := os.Stat(dst); err == nil && info.Mode().Perm() != 0640 {
+			t.Errorf("%s: target mode = %v", name, info.Mode().Perm())
+		}
+		if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary file left: %v", name, err)
+		}
+	}
+}
+
+func TestAfterCollect(t *testing.T) {
+	cases := []struct {
+		name     string
+		action   string
+		modified bool // 确认之前又被修改了
+		// 执行之后应该存在的文件, 相对于测试目录
+		exist   []string
+		missing []string
+	}{
+		{name: "delete", action: afterCollectDelete,
+			missing: []string{"root/a/list/1.list", "root/a/list/1.list.done"}},
+		{name: "move", action: afterCollectMove,
+			exist:   []string{"archive/a/list/1.list", "archive/a/list/1.list.done"},
+			missing: []string{"root/a/list/1.list", "root/a/list/1.list.done"}},
+		{name: "rename", action: afterCollectRename,
+			exist:   []string{"root/a/list/1.list.collected", "root/a/list/1.list.done"},
+			missing: []string{"root/a/list/1.list"}},
+		{name: "modified since sent", action: afterCollectDelete, modified: true,
+			exist: []string{"root/a/list/1.list", "root/a/list/1.list.done"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := t.TempDir()
+			root := filepath.Join(base, "root")
+			dir := filepath.Join(root, "a", "list")
+			info := writeFile(t, filepath.Join(dir, "1.list"), "content")
+			writeFile(t, filepath.Join(dir, "1.list.done"), "")
+
+			cfg := config.DefaultCollectorConfig
+			cfg.DoneSuffix = ".done"
+			cfg.AfterCollect = config.AfterCollectConfig{
+				Action:       tc.action,
+				MoveTo:       filepath.Join(base, "archive"),
+				RenameSuffix: ".collected",
+			}
+			c := &collector{
+				name:          "list",
+				paths:         []string{root},
+				config:        cfg,
+				registrarFile: registrarFile{path: filepath.Join(base, "data", "registrar-list.json")},
+				registrar:     map[string]map[string]*fileState{},
+				backend:       nopRegistrar{},
+				client:        &recordingClient{},
+			}
+			state := c.setState(dir, "1.list", &fileState{Size: info.Size(), ModTime: info.ModTime()})
+			bt := &lsbeat{}
+			if !bt.publishFile(c, dir, info, state, nil) {
+				t.Fatal("publish failed")
+			}
+			if tc.modified {
+				writeFile(t, filepath.Join(dir, "1.list"), "modified content")
+			}
+			bt.runAfterCollect()
+
+			for _, name := range tc.exist {
+				if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+			for _, name := range tc.missing {
+				if _, err := os.Stat(filepath.Join(base, name)); !os.IsNotExist(err) {
+					t.Errorf("%s still exists: %v", name, err)
+				}
+			}
+			// 执行了动作的文件从 registrar 中移除
+			if state := c.state(dir, "1.list"); (state == nil) != !tc.modified {
+				t.Errorf("registrar state = %+v", state)
+			}
+		})
+	}
+}
+
+func TestAfterCollectAcrossRestart(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "root", "a", "list")
+	registrarPath := filepath.Join(base, "registrar-list.json")
+	infos := map[string]os.FileInfo{}
+	for _, name := range []string{"sent.list", "acked.list"} {
+		infos[name] = writeFile(t, filepath.Join(dir, name), name)
+	}
+	// 目标是非空的目录, rename 失败
+	blocker := filepath.Join(dir, "acked.list.collected")
+	writeFile(t, filepath.Join(blocker, "x"), "")
+
+	cfg := config.DefaultCollectorConfig
+	cfg.AfterCollect = config.AfterCollectConfig{Action: afterCollectRename, RenameSuffix: ".collected"}
+	newCollector := func(registrar map[string]map[string]*fileState) *collector {
+		return &collector{
+			name:          "list",
+			config:        cfg,
+			registrarFile: registrarFile{path: registrarPath},
+			registrar:     registrar,
+			backend:       nopRegistrar{},
+			client:        &recordingClient{},
+		}
+	}
+
+	// 两个文件都发送了, 只有 acked.list 被确认, 它的动作失败了
+	c := newCollector(map[string]map[string]*fileState{})
+	bt := &lsbeat{}
+	for _, name := range []string{"sent.list", "acked.list"} {
+		info := infos[name]
+		state := c.setState(dir, name, &fileState{CollectedTime: time.Now(), Size: info.Size(), ModTime: info.ModTime()})
+		if !bt.publishFile(c, dir, info, state, []beat.Event{{}}) {
+			t.Fatal("publish failed")
+		}
+	}
+	bt.onACK(1, []interface{}{c.client.(*recordingClient).events[1].Private})
+	bt.runAfterCollect()
+	if err := saveRegistrar(registrarPath, c.registrar, registrarPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新启动
+	registrar, err := loadRegistrar(registrarPath, registrarPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newCollector(registrar)
+	bt = &lsbeat{}
+	bt.resumeAfterCollect(c)
+
+	sent := c.state(dir, "sent.list")
+	if sent == nil || sent.AfterCollect != afterCollectSent || !c.shouldCollect(sent, infos["sent.list"].ModTime(), time.Now()) {
+		t.Errorf("unacknowledged file not sent again: %+v", sent)
+	}
+	bt.runAfterCollect()
+	if _, err := os.Stat(filepath.Join(dir, "acked.list.collected")); err != nil {
+		t.Errorf("after_collect of the acknowledged file not run again: %v", err)
+	}
+	if state := c.state(dir, "acked.list"); state != nil {
+		t.Errorf("acked.list still in the registrar: %+v", state)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sent.list")); err != nil {
+		t.Errorf("unacknowledged file renamed: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package beater
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// 二进制文件的处理方式
+const (
+	binarySkip     = "skip"     // 不发送, 只在 registrar 中记录
+	binaryBase64   = "base64"   // 内容以 base64 编码放到 content_base64 字段
+	binaryMetadata = "metadata" // 只发送文件的元数据
+)
+
+// 只检查文件开头的这么多字节
+const binarySniffLen = 8000
+
+func checkBinaryPolicy(policy string) error {
+	switch policy {
+	case binarySkip, binaryBase64, binaryMetadata:
+		return nil
+	}
+	return fmt.Errorf("unsupported binary_policy '%s'", policy)
+}
+
+// isBinary 根据文件开头的内容判断是否为二进制文件:
+// 包含 NUL 字节, 或者控制字符所占比例超过 threshold.
+// UTF-16 编码的文本本身就含有大量 NUL, 因此只看控制字符的比例.
+func isBinary(content []byte, enc string, threshold float64) bool {
+	block := content
+	if len(block) > binarySniffLen {
+		block = block[:binarySniffLen]
+	}
+	if len(block) == 0 {
+		return false
+	}
+
+	utf16 := strings.HasPrefix(enc, "utf-16")
+	if !utf16 && bytes.IndexByte(block, 0) >= 0 {
+		return true
+	}
+
+	nonPrintable := 0
+	for _, c := range block {
+		if c == 0 && utf16 {
+			continue
+		}
+		if (c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != '\b') || c == 0x7f {
+			nonPrintable++
+		}
+	}
+	return float64(nonPrintable)/float64(len(block)) > threshold
+}
@@ -0,0 +1,66 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestIsBinary(t *testing.T) {
+	cases := []struct {
+		name      string
+		content   []byte
+		enc       string
+		threshold float64
+		binary    bool
+	}{
+		{"empty", nil, "utf-8", 0.3, false},
+		{"text", []byte("a\tb\r\nc\f\n"), "utf-8", 0.3, false},
+		{"nul", []byte("abc\x00def"), "utf-8", 0.3, true},
+		{"nul after the sniffed block", append(bytes.Repeat([]byte("a"), binarySniffLen), 0), "utf-8", 0.3, false},
+		{"control characters above threshold", []byte("ab\x01\x02\x03"), "utf-8", 0.5, true},
+		{"control characters below threshold", []byte("abcd\x01\x02"), "utf-8", 0.5, false},
+		{"del", []byte("a\x7f"), "utf-8", 0.3, true},
+		{"threshold 1 allows everything but nul", []byte("\x01\x02\x03"), "gbk", 1, false},
+		{"utf-16le text", []byte("A\x00B\x00\n\x00"), "utf-16le", 0.3, false},
+		{"utf-16be text", []byte("\x00A\x00B\x00\n"), "utf-16be", 0.3, false},
+		{"utf-16 control characters", []byte("\x01\x00\x02\x00\x03\x00"), "utf-16le", 0.3, true},
+	}
+	for _, c := range cases {
+		if got := isBinary(c.content, c.enc, c.threshold); got != c.binary {
+			t.Errorf("%s: isBinary = %v, want %v", c.name, got, c.binary)
+		}
+	}
+}
+
+func TestSkipBinaryRecordsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1.list"), []byte("\x00\x01\x02binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "1.list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// skip 时不会发送事件, 不需要 client
+	cfg := config.DefaultCollectorConfig
+	c := &collector{name: "list", config: cfg, registrar: map[string]map[string]*fileState{}}
+	bt := &lsbeat{}
+	bt.send(c, dir, info, nil)
+
+	state := c.state(dir, "1.list")
+	if state == nil || state.Skipped != skipBinary || state.Size != info.Size() || state.CollectedTime.IsZero() {
+		t.Fatalf("state = %+v", state)
+	}
+	// 文件不变时不再检查
+	if c.shouldCollect(state, info.ModTime(), state.CollectedTime) {
+		t.Error("skipped file collected again without being modified")
+	}
+}
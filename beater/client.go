@@ -0,0 +1,98 @@
+package beater
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/fmtstr"
+	"github.com/elastic/beats/v7/libbeat/processors"
+	"github.com/elastic/beats/v7/libbeat/processors/add_formatted_index"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// clientConfig 根据采集器的配置生成连接 publisher pipeline 时使用的配置,
+// 每个采集器可以有自己的 processors, pipeline, index 和 fields.
+func clientConfig(info beat.Info, c config.CollectorConfig) (beat.ClientConfig, error) {
+	procs := processors.NewList(nil)
+
+	// index 通过 processor 设置, 需要排在用户配置的 processors 前面
+	if !c.Index.IsEmpty() {
+		staticFields := fmtstr.FieldsForBeat(info.Beat, info.Version)
+		timestampFormat, err := fmtstr.NewTimestampFormatString(&c.Index, staticFields)
+		if err != nil {
+			return beat.ClientConfig{}, err
+		}
+		procs.AddProcessor(add_formatted_index.New(timestampFormat))
+	}
+
+	userProcessors, err := processors.New(c.Processors)
+	if err != nil {
+		return beat.ClientConfig{}, err
+	}
+	if userProcessors != nil {
+		procs.AddProcessors(*userProcessors)
+	}
+
+	meta := common.MapStr{}
+	if c.Pipeline != "" {
+		meta["pipeline"] = c.Pipeline
+	}
+
+	return beat.ClientConfig{
+		Processing: beat.ProcessingConfig{
+			EventMetadata: c.EventMetadata,
+			Meta:          meta,
+			Processor:     procs,
+			KeepNull:      c.KeepNull,
+		},
+	}, nil
+}
+
+// stoppableClient 在 Stop 时只打断阻塞的 Publish (比如 output 不可用时).
+// 没有事件在发送时不关闭 client, 由 shutdown 关闭, 已经发送的事件还可以被确认.
+type stoppableClient struct {
+	beat.Client
+
+	mu         sync.Mutex
+	publishing bool
+	stopped    bool
+}
+
+// publish 发送一个文件的所有事件, 返回 false 表示被 Stop 打断, 事件可能没有全部进入 pipeline
+func (c *stoppableClient) publish(events []beat.Event) bool {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return false
+	}
+	c.publishing = true
+	c.mu.Unlock()
+
+	c.Client.PublishAll(events)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.publishing = false
+	return !c.stopped
+}
+
+func (c *stoppableClient) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	publishing := c.publishing
+	c.mu.Unlock()
+	if publishing {
+		c.Client.Close()
+	}
+}
+
+// publishEvents 发送一个文件的所有事件, 返回 false 表示没有全部发送
+func publishEvents(client beat.Client, events []beat.Event) bool {
+	if c, ok := client.(*stoppableClient); ok {
+		return c.publish(events)
+	}
+	client.PublishAll(events)
+	return true
+}
@@ -0,0 +1,90 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// 模拟 output 不可用, PublishAll 阻塞到 client 被关闭
+type blockingClient struct {
+	publishing chan struct{}
+	closed     chan struct{}
+}
+
+func (c *blockingClient) Publish(e beat.Event) { c.PublishAll([]beat.Event{e}) }
+func (c *blockingClient) PublishAll(es []beat.Event) {
+	close(c.publishing)
+	<-c.closed
+}
+func (c *blockingClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestStopWhilePublishing(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1.list", "2.list"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("content of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2.list 之前采集过, 被打断时恢复为之前的状态
+	prev := &fileState{CollectedTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Size: 1, Hash: "old"}
+
+	for _, name := range []string{"1.list", "2.list"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &stoppableClient{Client: &blockingClient{
+			publishing: make(chan struct{}),
+			closed:     make(chan struct{}),
+		}}
+		c := &collector{
+			name:      "list",
+			config:    config.DefaultCollectorConfig,
+			registrar: map[string]map[string]*fileState{dir: {"2.list": prev}},
+			timestamp: &fileTimestamp{source: timestampCollected},
+			client:    client,
+		}
+
+		done := make(chan struct{})
+		go func() {
+			(&lsbeat{}).send(c, dir, info, nil)
+			close(done)
+		}()
+		<-client.Client.(*blockingClient).publishing
+		client.stop()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: send not interrupted by stop", name)
+		}
+
+		state := c.state(dir, name)
+		switch name {
+		case "1.list":
+			if state != nil {
+				t.Errorf("%s: interrupted file recorded as collected: %+v", name, state)
+			}
+		case "2.list":
+			if state != prev {
+				t.Errorf("%s: state = %+v, want %+v", name, state, prev)
+			}
+		}
+
+		// 停止之后不再发送
+		if publishEvents(client, []beat.Event{{}}) {
+			t.Errorf("%s: publish after stop succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// diff.mode 的取值
+const (
+	diffNone    = ""
+	diffLines   = "lines"   // 发送新增和删除的行
+	diffUnified = "unified" // 发送 unified diff
+)
+
+// 变化的行数超过这个值时不再计算 diff, 只发送完整的内容.
+// 回溯需要保存每一轮的状态, 内存占用和这个值的平方成正比 (1000 时约 8MB)
+const diffMaxEdits = 1000
+
+func checkDiffMode(mode string) error {
+	switch mode {
+	case diffNone, diffLines, diffUnified:
+		return nil
+	}
+	return fmt.Errorf("unsupported diff.mode '%s'", mode)
+}
+
+// snapshot 的保存位置, 每个文件一个 gzip 压缩的快照
+func (c *collector) snapshotPath(fullPath string) string {
+	sum := sha1.Sum([]byte(fullPath))
+	return filepath.Join(filepath.Dir(c.registrarFile.path), "snapshots", c.name, hex.EncodeToString(sum[:])+".gz")
+}
+
+// 读取上一次采集时的内容, 没有快照时返回 false
+func (c *collector) loadSnapshot(fullPath string) (string, bool) {
+	f, err := os.Open(c.snapshotPath(fullPath))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return "", false
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", false
+	}
+	return string(content), true
+}
+
+func (c *collector) saveSnapshot(fullPath string, content string) error {
+	path := c.snapshotPath(fullPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(content)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名, 避免留下不完整的快照
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (c *collector) removeSnapshot(fullPath string) {
+	os.Remove(c.snapshotPath(fullPath))
+}
+
+func (c *collector) renameSnapshot(oldPath, newPath string) {
+	os.Rename(c.snapshotPath(oldPath), c.snapshotPath(newPath))
+}
+
+// contentDiff 计算 diff 字段, 变化太多时返回 nil
+func contentDiff(mode string, filename string, old, new string, context int) common.MapStr {
+	a, b := splitContent(old), splitContent(new)
+	ops := diffSequences(a, b)
+	if ops == nil {
+		return nil
+	}
+
+	var added, removed []string
+	for _, op := range ops {
+		switch op.kind {
+		case '+':
+			added = append(added, op.line)
+		case '-':
+			removed = append(removed, op.line)
+		}
+	}
+
+	result := common.MapStr{
+		"added_count":   len(added),
+		"removed_count": len(removed),
+	}
+	if mode == diffUnified {
+		result["unified"] = unifiedDiff(filename, ops, context)
+	} else {
+		result["added"] = added
+		result["removed"] = removed
+	}
+	return result
+}
+
+func splitContent(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte // ' ' 不变, '+' 新增, '-' 删除
+	line string
+}
+
+// diffSequences 计算最短编辑序列, 编辑次数超过 diffMaxEdits 时返回 nil.
+// 相同的开头和结尾不参与计算, 文件只是追加了内容时不需要运行 Myers 算法.
+func diffSequences(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	middle := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if middle == nil {
+		return nil
+	}
+	ops := make([]diffOp, 0, prefix+len(middle)+suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, middle...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// minEdits 是编辑次数的下界: 只在一边出现的行 (按出现次数计) 至少需要一次新增或删除
+func minEdits(a, b []string) int {
+	count := make(map[string]int, len(a))
+	for _, line := range a {
+		count[line]++
+	}
+	for _, line := range b {
+		count[line]--
+	}
+	edits := 0
+	for _, c := range count {
+		if c < 0 {
+			c = -c
+		}
+		edits += c
+	}
+	return edits
+}
+
+// myersDiff 使用 Myers 算法计算最短编辑序列, 编辑次数超过 diffMaxEdits 时返回 nil
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	if n+m == 0 {
+		return []diffOp{}
+	}
+	if minEdits(a, b) > diffMaxEdits {
+		return nil
+	}
+
+	max := n + m
+	if max > diffMaxEdits {
+		max = diffMaxEdits
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] 保存第 d 轮开始前 v[-d..d] 的值, 用于回溯
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[offset-d:offset+d+1])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(a, b []string, trace [][]int) []diffOp {
+	x, y := len(a), len(b)
+	var ops []diffOp
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[prevK+d]
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff 按照 diff -u 的格式输出, context 为每个 hunk 前后保留的行数
+func unifiedDiff(filename string, ops []diffOp, context int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", filename, filename)
+
+	i := 0
+	for i < len(ops) {
+		// 找到下一处变化
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i >= len(ops) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// 两处变化之间不变的行不超过 2*context 时合并到一个 hunk
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			same := end
+			for same < len(ops) && ops[same].kind == ' ' {
+				same++
+			}
+			if same >= len(ops) || same-end > 2*context {
+				end += context
+				if end > len(ops) {
+					end = len(ops)
+				}
+				break
+			}
+			end = same
+		}
+
+		// 计算 hunk 在新旧文件中的起始行号
+		oldLine, newLine := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		if oldCount == 0 {
+			oldLine--
+		}
+		if newCount == 0 {
+			newLine--
+		}
+
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// removeOrphanSnapshots 删除 registrar 中已经没有条目的文件的快照, 比如 registrar
+// 被修改过, 或者 path_rewrite 改变了文件的路径. 在加载 registrar 之后调用.
+func (c *collector) removeOrphanSnapshots() {
+	dir := filepath.Dir(c.snapshotPath(""))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	known := map[string]bool{}
+	for path, files := range c.registrar {
+		for filename := range files {
+			known[filepath.Base(c.snapshotPath(filepath.Join(path, filename)))] = true
+		}
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || known[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logp.Info("%s collector: removed %d snapshots of files no longer in the registrar", c.name, removed)
+	}
+}
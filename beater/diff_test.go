@@ -0,0 +1,120 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestContentDiffLines(t *testing.T) {
+	diff := contentDiff(diffLines, "1.list", "a\nb\nc\n", "a\nc\nd\n", 3)
+	if !reflect.DeepEqual(diff["added"], []string{"d"}) {
+		t.Errorf("added = %v", diff["added"])
+	}
+	if !reflect.DeepEqual(diff["removed"], []string{"b"}) {
+		t.Errorf("removed = %v", diff["removed"])
+	}
+}
+
+func TestContentDiffUnified(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	new := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n"
+	diff := contentDiff(diffUnified, "1.list", old, new, 1)
+
+	expected := "--- a/1.list\n+++ b/1.list\n" +
+		"@@ -4,3 +4,3 @@\n 4\n-5\n+five\n 6\n" +
+		"@@ -10,1 +10,2 @@\n 10\n+11\n"
+	if diff["unified"] != expected {
+		t.Errorf("unified =\n%s\nwant\n%s", diff["unified"], expected)
+	}
+}
+
+func TestDiffSequencesLarge(t *testing.T) {
+	var old []string
+	for i := 0; i < 100000; i++ {
+		old = append(old, strconv.Itoa(i))
+	}
+
+	// 追加内容: 相同的开头不参与计算
+	appended := append(append([]string{}, old...), "x", "y")
+	ops := diffSequences(old, appended)
+	if len(ops) != len(appended) || ops[len(ops)-2] != (diffOp{'+', "x"}) || ops[len(ops)-1] != (diffOp{'+', "y"}) {
+		t.Errorf("append: %d ops, last %v", len(ops), ops[len(ops)-2:])
+	}
+
+	// 变化太多时直接放弃
+	var rewritten []string
+	for i := range old {
+		rewritten = append(rewritten, "new "+old[i])
+	}
+	if ops := diffSequences(old, rewritten); ops != nil {
+		t.Errorf("rewrite: %d ops, want nil", len(ops))
+	}
+
+	// 中间的修改
+	changed := append([]string{}, old...)
+	changed[500] = "changed"
+	ops = diffSequences(old, changed)
+	var a, b []string
+	for _, op := range ops {
+		if op.kind != '+' {
+			a = append(a, op.line)
+		}
+		if op.kind != '-' {
+			b = append(b, op.line)
+		}
+	}
+	if len(ops) != len(old)+1 || !reflect.DeepEqual(a, old) || !reflect.DeepEqual(b, changed) {
+		t.Errorf("change: %d ops", len(ops))
+	}
+}
+
+func TestSnapshotCleanup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.list"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{
+		name:          "list",
+		registrarFile: registrarFile{path: filepath.Join(t.TempDir(), "registrar-list.json")},
+		registrar: map[string]map[string]*fileState{dir: {
+			"a.list": {Size: 1},
+			"b.list": {Size: 1},
+		}},
+	}
+	for _, name := range []string{"a.list", "b.list", "c.list"} {
+		if err := c.saveSnapshot(filepath.Join(dir, name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasSnapshot := func(name string) bool {
+		_, ok := c.loadSnapshot(filepath.Join(dir, name))
+		return ok
+	}
+
+	// 没有开启 lifecycle_events 时被删除的文件也要移除快照
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.forgetMissing(dir, files) {
+		t.Error("registrar not modified")
+	}
+	if c.state(dir, "b.list") != nil || hasSnapshot("b.list") {
+		t.Error("missing file not forgotten")
+	}
+
+	// registrar 中没有条目的快照在加载 registrar 之后被删除
+	c.removeOrphanSnapshots()
+	if hasSnapshot("c.list") {
+		t.Error("orphan snapshot not removed")
+	}
+	if !hasSnapshot("a.list") {
+		t.Error("snapshot of a known file removed")
+	}
+}
@@ -0,0 +1,36 @@
+package beater
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/beat/events"
+)
+
+// 文件内容的哈希, 同时记录在 registrar 和事件中
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// documentID 由文件的身份 (采集器和路径), 内容的哈希以及块的编号生成.
+// 同样的内容重复采集时得到相同的 _id, Elasticsearch 中会覆盖而不是产生重复的文档.
+func documentID(c *collector, fullPath, hash, chunk string) string {
+	h := sha1.New()
+	for _, part := range []string{c.name, fullPath, hash, chunk} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 设置 @metadata._id, 并使用 index 操作覆盖已有的文档
+func setDocumentID(c *collector, event *beat.Event, fullPath, hash, chunk string) {
+	if !c.config.DocumentID {
+		return
+	}
+	event.SetID(documentID(c, fullPath, hash, chunk))
+	event.Meta[events.FieldMetaOpType] = "index"
+}
@@ -0,0 +1,172 @@
+package beater
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+const encodingAuto = "auto"
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// 支持的编码, utf-8 单独处理, 不在这里
+var encodings = map[string]encoding.Encoding{
+	"gbk":      simplifiedchinese.GBK,
+	"gb18030":  simplifiedchinese.GB18030,
+	"utf-16le": unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf-16be": unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+	"latin1":   charmap.ISO8859_1,
+}
+
+// 统一编码名称的写法, 比如 UTF8 -> utf-8
+func normalizeEncoding(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "utf8":
+		return "utf-8"
+	case "utf16le":
+		return "utf-16le"
+	case "utf16be":
+		return "utf-16be"
+	case "iso-8859-1", "iso8859-1":
+		return "latin1"
+	}
+	return name
+}
+
+func checkEncoding(name string) error {
+	name = normalizeEncoding(name)
+	if name == "utf-8" || name == encodingAuto {
+		return nil
+	}
+	if _, ok := encodings[name]; !ok {
+		return fmt.Errorf("unsupported encoding '%s'", name)
+	}
+	return nil
+}
+
+// 根据 BOM 猜测编码, 没有 BOM 时合法的 UTF-8 当作 utf-8, 否则当作 gb18030
+func sniffEncoding(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, bomUTF8):
+		return "utf-8"
+	case bytes.HasPrefix(content, bomUTF16LE):
+		return "utf-16le"
+	case bytes.HasPrefix(content, bomUTF16BE):
+		return "utf-16be"
+	case utf8.Valid(content):
+		return "utf-8"
+	}
+	return "gb18030"
+}
+
+// 得到文件实际使用的编码, auto 时根据内容猜测
+func resolveEncoding(content []byte, name string) string {
+	name = normalizeEncoding(name)
+	if name == encodingAuto {
+		return sniffEncoding(content)
+	}
+	return name
+}
+
+// decodeContent 将文件内容从 name 编码转换为 UTF-8.
+// 无法解码的字节替换为 U+FFFD, 返回值中包含实际使用的编码以及被替换的字符数.
+func decodeContent(content []byte, name string) (string, string, int, error) {
+	name = resolveEncoding(content, name)
+
+	if name == "utf-8" {
+		text, invalid := sanitizeUTF8(bytes.TrimPrefix(content, bomUTF8))
+		return text, name, invalid, nil
+	}
+
+	enc, ok := encodings[name]
+	if !ok {
+		return "", name, 0, fmt.Errorf("unsupported encoding '%s'", name)
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", name, 0, err
+	}
+	// 解码器已经把非法字节替换为 U+FFFD, 但文件中也可能本来就有 U+FFFD,
+	// 有 U+FFFD 时再逐个字符解码一遍, 只统计替换的次数
+	text := string(decoded)
+	invalid := 0
+	if strings.ContainsRune(text, utf8.RuneError) {
+		invalid = countReplacements(enc, content)
+	}
+	return text, name, invalid, nil
+}
+
+// countReplacements 统计解码时被替换为 U+FFFD 的字符数
+func countReplacements(enc encoding.Encoding, content []byte) int {
+	replacement := string(utf8.RuneError)
+	genuine := encodedReplacement(enc)
+	dec := enc.NewDecoder()
+	dst := make([]byte, utf8.UTFMax)
+	invalid := 0
+	for len(content) > 0 {
+		// dst 只能放下一个 U+FFFD, 输出 U+FFFD 时 content[:nSrc] 就是它对应的输入
+		nDst, nSrc, err := dec.Transform(dst[:len(replacement)], content, true)
+		if err == transform.ErrShortDst && nDst == 0 {
+			// 需要 4 个字节的字符
+			nDst, nSrc, _ = dec.Transform(dst, content, true)
+		}
+		if nSrc == 0 {
+			break
+		}
+		// 第一个字符之前可能还有 BOM
+		if string(dst[:nDst]) == replacement && (genuine == nil || !bytes.HasSuffix(content[:nSrc], genuine)) {
+			invalid++
+		}
+		content = content[nSrc:]
+	}
+	return invalid
+}
+
+// encodedReplacement 返回 U+FFFD 在 enc 中的字节序列, enc 不能表示 U+FFFD 时返回 nil.
+// UTF-16 的编码器会先写入 BOM, 因此取 "a\uFFFD" 和 "a" 的编码结果之差.
+func encodedReplacement(enc encoding.Encoding) []byte {
+	prefix, err := enc.NewEncoder().Bytes([]byte("a"))
+	if err != nil {
+		return nil
+	}
+	both, err := enc.NewEncoder().Bytes([]byte("a" + string(utf8.RuneError)))
+	if err != nil || !bytes.HasPrefix(both, prefix) {
+		return nil
+	}
+	return both[len(prefix):]
+}
+
+// 将非法的 UTF-8 序列逐个替换为 U+FFFD 并计数
+func sanitizeUTF8(content []byte) (string, int) {
+	if utf8.Valid(content) {
+		return string(content), 0
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(content))
+	invalid := 0
+	for len(content) > 0 {
+		r, size := utf8.DecodeRune(content)
+		if r == utf8.RuneError && size <= 1 {
+			sb.WriteRune(utf8.RuneError)
+			invalid++
+		} else {
+			sb.Write(content[:size])
+		}
+		content = content[size:]
+	}
+	return sb.String(), invalid
+}
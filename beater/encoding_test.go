@@ -0,0 +1,76 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import "testing"
+
+func TestDecodeContent(t *testing.T) {
+	cases := []struct {
+		name     string
+		encoding string
+		content  string
+		text     string
+		resolved string
+		invalid  int
+	}{
+		{"utf-8", "utf-8", "中文\n", "中文\n", "utf-8", 0},
+		{"utf-8 bom", "utf-8", "\xEF\xBB\xBFabc", "abc", "utf-8", 0},
+		{"utf-8 invalid", "utf-8", "a\xFFb\xE4\xB8", "a�b��", "utf-8", 3},
+		{"utf-8 genuine replacement", "utf8", "a�b", "a�b", "utf-8", 0},
+		{"gbk", "gbk", "\xD6\xD0\xCE\xC4", "中文", "gbk", 0},
+		{"gbk invalid", "GBK", "\xD6\xD0\xFF", "中�", "gbk", 1},
+		{"gb18030 four bytes", "gb18030", "\x95\x32\x82\x36", "\U00020000", "gb18030", 0},
+		{"gb18030 four bytes and invalid", "gb18030", "\x95\x32\x82\x36\xFF", "\U00020000�", "gb18030", 1},
+		{"gb18030 genuine replacement", "gb18030", "a\x84\x31\xA4\x37b", "a�b", "gb18030", 0},
+		{"gb18030 genuine and invalid", "gb18030", "\x84\x31\xA4\x37\xFF", "��", "gb18030", 1},
+		{"utf-16le bom", "utf-16le", "\xFF\xFEA\x00\x2D\x4E", "A中", "utf-16le", 0},
+		{"utf-16le without bom", "utf16le", "A\x00\x2D\x4E", "A中", "utf-16le", 0},
+		{"utf-16be bom", "utf-16be", "\xFE\xFF\x00A\x4E\x2D", "A中", "utf-16be", 0},
+		{"utf-16be without bom", "utf-16be", "\x00A\x4E\x2D", "A中", "utf-16be", 0},
+		{"utf-16le unpaired surrogate", "utf-16le", "\x00\xD8A\x00", "�A", "utf-16le", 1},
+		{"utf-16le genuine replacement", "utf-16le", "\xFF\xFE\xFD\xFFA\x00", "�A", "utf-16le", 0},
+		{"latin1", "iso-8859-1", "caf\xE9", "café", "latin1", 0},
+		{"auto utf-8", "auto", "中文", "中文", "utf-8", 0},
+		{"auto utf-16le bom", "auto", "\xFF\xFEA\x00", "A", "utf-16le", 0},
+		{"auto utf-16be bom", "auto", "\xFE\xFF\x00A", "A", "utf-16be", 0},
+		{"auto gb18030", "auto", "\xD6\xD0\xCE\xC4", "中文", "gb18030", 0},
+	}
+
+	for _, c := range cases {
+		text, resolved, invalid, err := decodeContent([]byte(c.content), c.encoding)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if text != c.text || resolved != c.resolved || invalid != c.invalid {
+			t.Errorf("%s: got %q, %s, %d invalid, want %q, %s, %d invalid",
+				c.name, text, resolved, invalid, c.text, c.resolved, c.invalid)
+		}
+	}
+
+	if _, _, _, err := decodeContent([]byte("abc"), "ebcdic"); err == nil {
+		t.Error("unsupported encoding accepted")
+	}
+}
+
+func TestSanitizeUTF8(t *testing.T) {
+	cases := []struct {
+		content string
+		text    string
+		invalid int
+	}{
+		{"", "", 0},
+		{"abc 中文", "abc 中文", 0},
+		{"a�b", "a�b", 0},
+		{"a\xC0b", "a�b", 1},
+		{"\xE4\xB8", "��", 2},
+		{"\xED\xA0\x80", "���", 3}, // UTF-8 编码的代理项
+	}
+	for _, c := range cases {
+		text, invalid := sanitizeUTF8([]byte(c.content))
+		if text != c.text || invalid != c.invalid {
+			t.Errorf("sanitizeUTF8(%q) = %q, %d, want %q, %d", c.content, text, invalid, c.text, c.invalid)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package beater
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errno 的名字, 比如 EACCES
+func errnoName(errno syscall.Errno) string {
+	return unix.ErrnoName(errno)
+}
@@ -0,0 +1,8 @@
+package beater
+
+import "syscall"
+
+// windows 上没有 errno 的名字, 只记录数值
+func errnoName(errno syscall.Errno) string {
+	return ""
+}
@@ -0,0 +1,56 @@
+package beater
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// 出错的操作, 记录在 error.operation 中
+const (
+	opWalk          = "walk"
+	opReadDir       = "read_dir"
+	opStat          = "stat"
+	opRead          = "read"
+	opDecode        = "decode"
+	opSaveRegistrar = "save_registrar"
+)
+
+// reportError 记录带有原因的错误日志, 开启 error_events 时再发送一个
+// event.kind 为 pipeline_error 的事件, 方便在各个主机上统一发现权限等问题.
+func (bt *lsbeat) reportError(c *collector, op string, path string, err error) {
+	logp.Err("%s collector: %s %s failed: %v", c.name, op, path, err)
+	if !c.config.ErrorEvents || c.client == nil {
+		return
+	}
+
+	now := time.Now()
+	errorFields := common.MapStr{
+		"message":   err.Error(),
+		"operation": op,
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		errorFields["errno"] = int(errno)
+		if name := errnoName(errno); name != "" {
+			errorFields["code"] = name
+		}
+	}
+
+	c.client.Publish(beat.Event{
+		Timestamp: now,
+		Fields: common.MapStr{
+			"type": c.name,
+			"path": path,
+			"event": common.MapStr{
+				"kind":     "pipeline_error",
+				"ingested": now,
+			},
+			"error": errorFields,
+		},
+	})
+}
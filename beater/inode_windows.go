@@ -0,0 +1,8 @@
+package beater
+
+import "os"
+
+// windows 上 FileInfo 中没有文件 ID, 重命名时只比较大小和修改时间
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,190 @@
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// event.action 的取值
+const (
+	actionCreated  = "created"
+	actionModified = "modified"
+	actionDeleted  = "deleted"
+	actionRenamed  = "renamed"
+)
+
+// publishLifecycle 对比 registrar 和目录中现有的文件, 为消失的文件发送 deleted 事件.
+// 如果消失的文件能和新出现的文件对应上 (inode 相同, 或大小和修改时间都相同),
+// 则认为是重命名, 发送 renamed 事件并把 registrar 中的状态转移过去, 不再重新采集.
+// files 为 nil 表示整个目录都已经不存在了. 返回 registrar 是否有改动.
+func (bt *lsbeat) publishLifecycle(c *collector, dir string, files []os.DirEntry, now time.Time) bool {
+	known := c.registrar[dir]
+	if len(known) == 0 {
+		return false
+	}
+
+	present := map[string]bool{}
+	var created []os.FileInfo
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != c.ext {
+			continue
+		}
+		present[file.Name()] = true
+		if _, ok := known[file.Name()]; ok {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			created = append(created, info)
+		}
+	}
+
+	modified := false
+	for filename, state := range known {
+		if present[filename] {
+			continue
+		}
+		modified = true
+		delete(known, filename)
+
+		if i := matchRenamed(state, created); i >= 0 {
+			info := created[i]
+			// 一个新文件只能是一个消失的文件重命名而来
+			created = append(created[:i], created[i+1:]...)
+			known[info.Name()] = state
+			present[info.Name()] = true
+			c.renameSnapshot(filepath.Join(dir, filename), filepath.Join(dir, info.Name()))
+			c.client.Publish(lifecycleEvent(c, dir, filename, state, actionRenamed, now, info))
+			continue
+		}
+		c.removeSnapshot(filepath.Join(dir, filename))
+		c.client.Publish(lifecycleEvent(c, dir, filename, state, actionDeleted, now, nil))
+	}
+
+	if len(known) == 0 {
+		delete(c.registrar, dir)
+	}
+	return modified
+}
+
+// removedDirectories 返回 registrar 中记录的, 这一次查找时没有找到并且已经不存在的目录.
+// 只考虑采集器的根目录下属于本实例的目录, 其他实例或其他配置留下的条目不受影响.
+func removedDirectories(c *collector, found []string, shard config.ShardConfig) []string {
+	discovered := make(map[string]bool, len(found))
+	for _, dir := range found {
+		discovered[dir] = true
+	}
+	var removed []string
+	for dir := range c.registrar {
+		if discovered[dir] {
+			continue
+		}
+		_, rel, ok := relativeToRoot(c.paths, dir)
+		if !ok || !ownsDirectory(shard, rel) {
+			continue
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// forgetDirectory 移除已经不存在的目录在 registrar 中的条目和快照,
+// 开启了 lifecycle_events 时为其中的文件发送 deleted 事件. 返回 registrar 是否有改动.
+func (bt *lsbeat) forgetDirectory(c *collector, dir string, now time.Time) bool {
+	if c.config.LifecycleEvents {
+		return bt.publishLifecycle(c, dir, nil, now)
+	}
+	files, ok := c.registrar[dir]
+	if !ok {
+		return false
+	}
+	for filename := range files {
+		c.removeSnapshot(filepath.Join(dir, filename))
+	}
+	delete(c.registrar, dir)
+	logp.Info("%s collector: directory %s removed", c.name, dir)
+	return true
+}
+
+// forgetMissing 在没有开启 lifecycle_events 时移除目录中已经不存在的文件的条目和快照,
+// 不发送事件. 返回 registrar 是否有改动.
+func (c *collector) forgetMissing(dir string, files []os.DirEntry) bool {
+	known := c.registrar[dir]
+	if len(known) == 0 {
+		return false
+	}
+	present := make(map[string]bool, len(files))
+	for _, file := range files {
+		present[file.Name()] = true
+	}
+	modified := false
+	for filename := range known {
+		if present[filename] {
+			continue
+		}
+		delete(known, filename)
+		c.removeSnapshot(filepath.Join(dir, filename))
+		modified = true
+	}
+	if len(known) == 0 {
+		delete(c.registrar, dir)
+	}
+	return modified
+}
+
+// 在新出现的文件中查找被重命名的文件, 返回它在 created 中的下标, 没有找到时返回 -1
+func matchRenamed(state *fileState, created []os.FileInfo) int {
+	for i, info := range created {
+		if info.Size() != state.Size || !info.ModTime().Equal(state.ModTime) {
+			continue
+		}
+		// 有 inode 的话还要求 inode 相同
+		if state.Inode != 0 && fileInode(info) != state.Inode {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// 删除和重命名事件中带上最后一次采集时记录的元数据
+func lifecycleEvent(c *collector, dir, filename string, state *fileState, action string, now time.Time, renamed os.FileInfo) beat.Event {
+	fullPath := filepath.Join(dir, filename)
+	fields := common.MapStr{
+		"type":           c.name,
+		"filename":       filename,
+		"path":           fullPath,
+		"modtime":        state.ModTime,
+		"size":           state.Size,
+		"collected_time": state.CollectedTime,
+		"event": common.MapStr{
+			"action":   action,
+			"ingested": now,
+		},
+	}
+	if renamed != nil {
+		fields["filename"] = renamed.Name()
+		fields["path"] = filepath.Join(dir, renamed.Name())
+		fields["old_filename"] = filename
+		fields["old_path"] = fullPath
+		logp.Info("file %s renamed to %s", fullPath, fields["path"])
+	} else {
+		logp.Info("file %s deleted", fullPath)
+	}
+	event := beat.Event{
+		Timestamp: now,
+		Fields:    fields,
+	}
+	setDocumentID(c, &event, fullPath, state.Hash, action)
+	return event
+}
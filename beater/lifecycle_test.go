@@ -0,0 +1,135 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// 记录发送的事件
+type recordingClient struct {
+	events []beat.Event
+}
+
+func (c *recordingClient) Publish(e beat.Event)       { c.events = append(c.events, e) }
+func (c *recordingClient) PublishAll(es []beat.Event) { c.events = append(c.events, es...) }
+func (c *recordingClient) Close() error               { return nil }
+
+func TestRenameMatchesOneFile(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	path := filepath.Join(dir, "c.list")
+	if err := os.WriteFile(path, []byte("same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个消失的文件大小和修改时间都和新文件相同, 没有记录 inode
+	client := &recordingClient{}
+	c := &collector{
+		name:          "list",
+		ext:           ".list",
+		registrarFile: registrarFile{path: filepath.Join(t.TempDir(), "registrar-list.json")},
+		registrar: map[string]map[string]*fileState{dir: {
+			"a.list": {Size: 4, ModTime: modTime},
+			"b.list": {Size: 4, ModTime: modTime},
+		}},
+		client: client,
+	}
+	bt := &lsbeat{}
+	if !bt.publishLifecycle(c, dir, files, time.Now()) {
+		t.Fatal("registrar not modified")
+	}
+
+	actions := map[string]int{}
+	for _, e := range client.events {
+		action, _ := e.Fields.GetValue("event.action")
+		actions[action.(string)]++
+	}
+	if actions[actionRenamed] != 1 || actions[actionDeleted] != 1 {
+		t.Errorf("actions = %v, want one renamed and one deleted", actions)
+	}
+	if len(c.registrar[dir]) != 1 || c.registrar[dir]["c.list"] == nil {
+		t.Errorf("registrar = %v", c.registrar[dir])
+	}
+}
+
+func TestRemovedDirectories(t *testing.T) {
+	root := t.TempDir()
+	shard := config.ShardConfig{Count: 2, Index: 0}
+	// 找到属于本实例和属于另一个实例的目录名
+	var mine, other string
+	for i := 0; mine == "" || other == ""; i++ {
+		rel := filepath.Join(fmt.Sprintf("d%d", i), "list")
+		if ownsDirectory(shard, rel) {
+			mine = rel
+		} else {
+			other = rel
+		}
+	}
+	existing := filepath.Join(root, "existing", "list")
+	if err := os.MkdirAll(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	state := func() map[string]*fileState { return map[string]*fileState{"1.list": {Size: 1}} }
+	c := &collector{
+		name:          "list",
+		ext:           ".list",
+		paths:         []string{root},
+		registrarFile: registrarFile{path: filepath.Join(t.TempDir(), "registrar-list.json")},
+		registrar: map[string]map[string]*fileState{
+			filepath.Join(root, mine):  state(),
+			filepath.Join(root, other): state(),
+			// 存在但是这一次没有找到, 比如查找时出错
+			existing:          state(),
+			"/elsewhere/list": state(),
+		},
+	}
+	removed := removedDirectories(c, nil, shard)
+	if len(removed) != 1 || removed[0] != filepath.Join(root, mine) {
+		t.Fatalf("removed = %v, want [%s]", removed, filepath.Join(root, mine))
+	}
+
+	// 没有开启 lifecycle_events 时也要移除 registrar 中的条目
+	bt := &lsbeat{}
+	if !bt.forgetDirectory(c, removed[0], time.Now()) {
+		t.Fatal("registrar not modified")
+	}
+	if _, ok := c.registrar[removed[0]]; ok || len(c.registrar) != 3 {
+		t.Errorf("registrar = %v", c.registrar)
+	}
+
+	// 开启时发送 deleted 事件
+	client := &recordingClient{}
+	c.client = client
+	c.config.LifecycleEvents = true
+	c.registrar[removed[0]] = state()
+	if !bt.forgetDirectory(c, removed[0], time.Now()) {
+		t.Fatal("registrar not modified")
+	}
+	if len(client.events) != 1 {
+		t.Fatalf("%d events, want 1", len(client.events))
+	}
+	if action, _ := client.events[0].Fields.GetValue("event.action"); action != actionDeleted {
+		t.Errorf("action = %v", action)
+	}
+	if _, ok := c.registrar[removed[0]]; ok {
+		t.Errorf("registrar = %v", c.registrar)
+	}
+}
@@ -0,0 +1,113 @@
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// registrar 所在目录下的锁文件, 防止两个 lsbeat 使用同一个 registrar.
+// libbeat 只锁定 path.data, 两个实例的 path.data 不同时 registrar 仍然可能相同.
+const registrarLockName = ".lsbeat-registrar.lock"
+
+// registrarLock 是一个 registrar 目录的排他锁, 持有者的 pid 和主机名记录在 <锁文件>.pid 中.
+// windows 上被锁定的文件不能通过其他句柄写入, 因此不写在锁文件中.
+type registrarLock struct {
+	fl *flock.Flock
+}
+
+// 锁被占用时重试的时间, 刚退出的实例 (比如重启时) 可能还没有释放锁
+var (
+	lockRetryTimeout  = 2 * time.Second
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// lockRegistrarDir 锁定 registrar 目录. 锁被占用时短暂重试, 仍然被占用则返回错误.
+// 锁文件不会被删除: 持有者退出时操作系统会释放锁, 删除被持有的锁文件会让两个进程同时持有锁.
+// <锁文件>.pid 只用于在错误信息中报告持有者.
+func lockRegistrarDir(dir string) (*registrarLock, error) {
+	lock, owner, err := tryLockRegistrarDir(dir, lockRetryTimeout)
+	if err != nil || lock != nil {
+		return lock, err
+	}
+	return nil, fmt.Errorf("registrar directory %s is in use by %s, two lsbeat instances must not share a registrar"+
+		" (set registrar_list_path and registrar_log_path to different directories)", dir, owner)
+}
+
+// tryLockRegistrarDir 在 timeout 内尝试锁定 registrar 目录, 锁被占用时返回 nil 和持有者的描述
+func tryLockRegistrarDir(dir string, timeout time.Duration) (*registrarLock, string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(dir, registrarLockName)
+
+	fl := flock.New(path)
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := fl.TryLock()
+		if err != nil {
+			return nil, "", fmt.Errorf("can not lock registrar directory %s: %v", dir, err)
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, describeLockOwner(path + ".pid"), nil
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	hostname, _ := os.Hostname()
+	if err := os.WriteFile(path+".pid", []byte(fmt.Sprintf("%d %s\n", os.Getpid(), hostname)), 0644); err != nil {
+		fl.Unlock()
+		return nil, "", fmt.Errorf("can not write lock owner %s.pid: %v", path, err)
+	}
+	return &registrarLock{fl: fl}, "", nil
+}
+
+// unlock 释放锁, 锁文件保留下来, 删除的话可能和同时打开了这个文件的进程冲突
+func (l *registrarLock) unlock() {
+	os.Remove(l.fl.Path() + ".pid")
+	l.fl.Unlock()
+}
+
+// readLockOwner 读取锁文件中的 pid 和主机名, 无法解析时 pid 为 0
+func readLockOwner(path string) (int, string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, ""
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, ""
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, ""
+	}
+	if len(fields) > 1 {
+		return pid, fields[1]
+	}
+	return pid, ""
+}
+
+// describeLockOwner 根据 .pid 文件描述锁的持有者. .pid 文件可能是过期的
+// (比如持有者在写入前被占用, 或者是 NFS 上其他主机的进程), 因此只作为参考.
+func describeLockOwner(pidPath string) string {
+	pid, host := readLockOwner(pidPath)
+	hostname, _ := os.Hostname()
+	switch {
+	case pid <= 0:
+		return "another process"
+	case host == "":
+		return fmt.Sprintf("lsbeat (pid %d)", pid)
+	case host == hostname && !processAlive(pid):
+		return fmt.Sprintf("another process (%s records pid %d, which is no longer running)", filepath.Base(pidPath), pid)
+	}
+	return fmt.Sprintf("lsbeat (pid %d on %s)", pid, host)
+}
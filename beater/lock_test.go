@@ -0,0 +1,97 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockRegistrarDir(t *testing.T) {
+	defer func(timeout time.Duration) { lockRetryTimeout = timeout }(lockRetryTimeout)
+	lockRetryTimeout = 200 * time.Millisecond
+	hostname, _ := os.Hostname()
+
+	t.Run("free", func(t *testing.T) {
+		dir := t.TempDir()
+		lock, err := lockRegistrarDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid, host := readLockOwner(filepath.Join(dir, registrarLockName+".pid")); pid != os.Getpid() || host != hostname {
+			t.Errorf("owner = %d %s", pid, host)
+		}
+		lock.unlock()
+
+		// 释放后可以再次锁定
+		lock, err = lockRegistrarDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.unlock()
+	})
+
+	t.Run("held", func(t *testing.T) {
+		dir := t.TempDir()
+		lock, err := lockRegistrarDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lock.unlock()
+
+		_, err = lockRegistrarDir(dir)
+		if err == nil {
+			t.Fatal("locked a registrar directory that is in use")
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+			t.Errorf("error does not report the owner: %v", err)
+		}
+	})
+
+	t.Run("stale pid", func(t *testing.T) {
+		dir := t.TempDir()
+		lock, err := lockRegistrarDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lock.unlock()
+
+		// .pid 指向已经退出的进程, 但锁仍然被持有: 不能删除锁文件
+		pidPath := filepath.Join(dir, registrarLockName+".pid")
+		const deadPid = 1 << 30
+		if err := os.WriteFile(pidPath, []byte(fmt.Sprintf("%d %s\n", deadPid, hostname)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = lockRegistrarDir(dir)
+		if err == nil {
+			t.Fatal("locked a registrar directory that is in use")
+		}
+		if !strings.Contains(err.Error(), "no longer running") {
+			t.Errorf("error does not report the stale owner: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, registrarLockName)); err != nil {
+			t.Errorf("lock file removed: %v", err)
+		}
+	})
+
+	t.Run("stale pid free", func(t *testing.T) {
+		dir := t.TempDir()
+		pidPath := filepath.Join(dir, registrarLockName+".pid")
+		if err := os.WriteFile(pidPath, []byte(fmt.Sprintf("%d %s\n", 1<<30, hostname)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		lock, err := lockRegistrarDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lock.unlock()
+		if pid, _ := readLockOwner(pidPath); pid != os.Getpid() {
+			t.Errorf("owner = %d, want %d", pid, os.Getpid())
+		}
+	})
+}
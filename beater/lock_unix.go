@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package beater
+
+import "syscall"
+
+// processAlive 判断本机上 pid 对应的进程是否还在运行
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
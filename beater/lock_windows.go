@@ -0,0 +1,13 @@
+package beater
+
+import "syscall"
+
+// processAlive 判断本机上 pid 对应的进程是否还在运行
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	syscall.CloseHandle(h)
+	return true
+}
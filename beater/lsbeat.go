@@ -5,45 +5,125 @@ package beater
  * 扫描间隔设置很长, 数个小时扫描一次
 
  registrar-list.json
- [{ "path": "/xxx/xxx/list": { "filename": "xxx.list", "collect_time": xxx } }]
+ { "version": 3, "entries": [{ "root": "/data", "path": "xxx/list", "files": [{ "filename": "xxx.list", "collected_time": xxx }] }] }
 
  registrar-log.json
- [{ "path": "/xxx/xxx/LOG": { "filename": "xxx.log", "collect_time": xxx } }]
+ { "version": 3, "entries": [{ "root": "/data", "path": "xxx/LOG", "files": [{ "filename": "xxx.log", "collected_time": xxx }] }] }
+
+ 旧版本的文件读取时自动升级, 见 registrar.go
 */
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
 	"github.com/elastic/beats/v7/libbeat/logp"
 
 	"github.com/Qiu-Weidong/lsbeat/config"
 )
 
+var once = flag.Bool("once", false, "Run lsbeat only once: collect all directories, wait for the events to be acknowledged and exit")
+
 // lsbeat configuration.
 type lsbeat struct {
-	done   chan struct{}
+	// Stop 时取消, 正在进行的采集在处理完当前文件后退出
+	ctx    context.Context
+	cancel context.CancelFunc
 	config config.Config
-	client beat.Client
+	// Stop 被调用的时间, 关闭时从这里开始计算 shutdown_timeout
+	stopTime time.Time
+
+	// 只采集一遍就退出
+	runOnce bool
+	// 只采集一遍时还没有被确认的事件
+	pending pendingEvents
+	// 不为 nil 时重新发送匹配的文件, 而不是正常采集
+	reingest *ReingestOptions
 
 	lastIndexTime time.Time
 
-	registrar_list map[string]map[string]time.Time
-	registrar_log  map[string]map[string]time.Time
+	collectors []*collector
+
+	// 动态加载 lsbeat.d 中的采集器, 没有开启 reload 时为 nil
+	reloader *cfgfile.Reloader
+	pipeline beat.PipelineConnector
+	// reloader 启动和停止的采集器, 在 Run 中下一轮开始时处理
+	changesMu sync.Mutex
+	changes   []collectorChange
+	// 已经停止的采集器, 重新启动时沿用查找到的目录
+	stopped map[string]*collector
+
+	// 各个 registrar 目录的锁, key 为目录
+	locks map[string]*registrarLock
+
+	// 本轮中被以写方式打开的文件, 用到时才去查找
+	writers map[string]bool
+	// 本轮中还没有写完的文件, key 为完整路径
+	unfinished map[string]unfinishedFile
+
+	// 所有事件都已被确认, 等待执行 after_collect 的文件
+	ackMu sync.Mutex
+	acked []*fileAck
 }
 
-// New creates an instance of lsbeat.
-func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+// 采集器, 内置 list 和 log 两种, 其他的定义在 lsbeat.d 中
+type collector struct {
+	name    string   // 事件中的 type 字段
+	dirName string   // 需要查找的目录名
+	ext     string   // 需要采集的文件后缀
+	paths   []string // 查找的根目录
+
+	config        config.CollectorConfig
+	registrarFile registrarFile
+	registrar     map[string]map[string]*fileState
+	backend       registrarBackend
+	// registrar 已经关闭, 采集器被 reloader 停止了
+	closed bool
 
+	// 上一次查找到的目录, discovered 为 false 时下一轮立即查找
+	dirs       []string
+	discovered bool
+
+	// 等待写入完成的文件
+	pending map[string]pendingFile
+
+	// 按行解析, 没有配置时为 nil
+	parser *recordParser
+
+	timestamp *fileTimestamp
+
+	// 每个采集器单独连接 publisher pipeline
+	clientConfig beat.ClientConfig
+	client       beat.Client
+}
+
+// 读取配置, 并补全 registrar 的文件名
+func unpackConfig(cfg *common.Config) (config.Config, error) {
 	c := config.DefaultConfig
+	// 同时报告无法识别的配置项和取值错误
+	unknown := config.CheckUnknownKeys(cfg)
 	if err := cfg.Unpack(&c); err != nil {
-		return nil, fmt.Errorf("Error reading config file: %v", err)
+		if unknown != nil {
+			return c, fmt.Errorf("Error reading config file: %v; %v", unknown, err)
+		}
+		return c, fmt.Errorf("Error reading config file: %v", err)
+	}
+	if unknown != nil {
+		return c, fmt.Errorf("Error reading config file: %v", unknown)
 	}
 
 	if !strings.HasSuffix(c.RegistrarListPath, ".json") {
@@ -55,103 +135,544 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 		// 需要添加文件名
 		c.RegistrarLogPath = filepath.Join(c.RegistrarLogPath, "registrar-log.json")
 	}
+	return c, nil
+}
+
+// 各个采集器的 registrar 文件, 供命令行工具使用
+type registrarFile struct {
+	collector string
+	path      string
+	backend   string
+	paths     registrarPaths
+}
+
+// registrarFiles 包括 lsbeat.d 中定义的采集器
+func registrarFiles(c config.Config) ([]registrarFile, error) {
+	specs, err := allCollectorSpecs(c)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]registrarFile, 0, len(specs))
+	for _, spec := range specs {
+		files = append(files, spec.registrar)
+	}
+	return files, nil
+}
+
+func (r registrarFile) open() (registrarBackend, error) {
+	return openRegistrar(r.backend, r.path, r.paths)
+}
+
+// 各个采集器查找的目录名, 文件后缀以及配置
+type collectorSpec struct {
+	name      string
+	dirName   string
+	ext       string
+	paths     []string
+	config    config.CollectorConfig
+	registrar registrarFile
+}
+
+// collectorSpecs 返回内置的 list 和 log 采集器
+func collectorSpecs(c config.Config) []collectorSpec {
+	paths := registrarPaths{roots: c.Path, rewrite: c.PathRewrite}
+	return []collectorSpec{
+		{name: "list", dirName: "list", ext: ".list", paths: c.Path, config: c.List,
+			registrar: registrarFile{collector: "list", path: c.RegistrarListPath, backend: c.RegistrarBackend, paths: paths}},
+		{name: "log", dirName: "LOG", ext: ".log", paths: c.Path, config: c.Log,
+			registrar: registrarFile{collector: "log", path: c.RegistrarLogPath, backend: c.RegistrarBackend, paths: paths}},
+	}
+}
+
+// allCollectorSpecs 返回内置的采集器以及 lsbeat.d 中当前定义的采集器
+func allCollectorSpecs(c config.Config) ([]collectorSpec, error) {
+	defined, err := loadCollectorDefinitions(c)
+	if err != nil {
+		return nil, err
+	}
+	return append(collectorSpecs(c), defined...), nil
+}
+
+// New creates an instance of lsbeat.
+func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+	bt, err := newLsbeat(b, cfg, *once)
+	if err != nil {
+		return nil, err
+	}
+	return bt, nil
+}
 
+// NewTestConfig 用于 lsbeat test config, 除了配置的取值还检查各个采集器的根目录是否可读,
+// registrar 所在的目录是否可写. 和启动时不同, 不会创建 registrar 目录.
+func NewTestConfig(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+	bt, err := newLsbeat(b, cfg, *once)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, c := range bt.collectors {
+		if err := c.checkPaths(false); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return bt, nil
+}
+
+// newLsbeat 创建 lsbeat, once 为 true 时只采集一遍
+func newLsbeat(b *beat.Beat, cfg *common.Config, once bool) (*lsbeat, error) {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	bt := &lsbeat{
-		done:   make(chan struct{}),
-		config: c,
+		ctx:     ctx,
+		cancel:  cancel,
+		config:  c,
+		runOnce: once || c.RunOnce,
+		stopped: map[string]*collector{},
+		locks:   map[string]*registrarLock{},
 
 		// 初始化 lastIndexTime
 		lastIndexTime: time.Now(),
+	}
 
-		registrar_list: loadRegistrar(c.RegistrarListPath),
-		registrar_log:  loadRegistrar(c.RegistrarLogPath),
+	// 只采集一遍时不需要动态加载, lsbeat.d 中的采集器和内置的一样在启动时创建
+	reload := c.Collectors.Enabled() && collectorsReloadEnabled(c.Collectors) && !bt.runOnce
+	specs := collectorSpecs(c)
+	if !reload {
+		specs, err = allCollectorSpecs(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// registrar 在 Run 中才打开, lsbeat test config 也会创建 lsbeat
+	for _, spec := range specs {
+		collector, err := newCollector(b.Info, spec)
+		if err != nil {
+			return nil, err
+		}
+		bt.collectors = append(bt.collectors, collector)
+	}
+
+	if reload {
+		bt.reloader = cfgfile.NewReloader(b.Publisher, c.Collectors)
+		// 开启 reload 时定义之后还可能被修正, 有错误时不退出, 只记录下来.
+		// 有错误的定义在修正之前不会启动
+		if _, err := loadCollectorDefinitions(c); err != nil {
+			logp.Warn("invalid collector definition, it is not started until fixed: %v", err)
+		}
 	}
 	return bt, nil
 }
 
+func newCollector(info beat.Info, spec collectorSpec) (*collector, error) {
+	name, c := spec.name, spec.config
+	if err := checkEncoding(c.Encoding); err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	if err := checkBinaryPolicy(c.BinaryPolicy); err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	parser, err := newParser(c.Parser)
+	if err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	timestamp, err := newFileTimestamp(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	if err := checkDiffMode(c.Diff.Mode); err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	if err := checkAfterCollect(c.AfterCollect); err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+	clientConfig, err := clientConfig(info, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s collector: %v", name, err)
+	}
+
+	return &collector{
+		name:          name,
+		dirName:       spec.dirName,
+		ext:           spec.ext,
+		paths:         spec.paths,
+		config:        c,
+		registrarFile: spec.registrar,
+		pending:       map[string]pendingFile{},
+		parser:        parser,
+		timestamp:     timestamp,
+		clientConfig:  clientConfig,
+	}, nil
+}
+
+// checkPaths 检查根目录是否可读, registrar 所在的目录是否可写, create 为 true 时创建 registrar 目录.
+// 只在启动采集器和 lsbeat test config 时检查, 读取配置的 registrar 和 scan 等命令不需要这些目录.
+func (c *collector) checkPaths(create bool) error {
+	var errs []string
+	for _, root := range c.paths {
+		if err := config.CheckReadableDir(root); err != nil {
+			errs = append(errs, fmt.Sprintf("path %s: %v", root, err))
+		}
+	}
+	dir := filepath.Dir(c.registrarFile.path)
+	if err := config.CheckWritableDir(dir, create); err != nil {
+		errs = append(errs, fmt.Sprintf("registrar directory %s: %v", dir, err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s collector: %s", c.name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// open 打开并加载采集器的 registrar
+func (c *collector) open() error {
+	backend, err := c.registrarFile.open()
+	if err != nil {
+		return fmt.Errorf("%s collector: %v", c.name, err)
+	}
+	registrar, err := backend.load()
+	if err != nil {
+		backend.close()
+		return fmt.Errorf("%s collector: can not load registrar: %v", c.name, err)
+	}
+	c.backend, c.registrar = backend, registrar
+	return nil
+}
+
+// openReadOnly 只读地加载 registrar, 修改不会被保存. 读取失败时 (比如 memlog 存储
+// 正在被运行中的 lsbeat 使用) 从空的 registrar 开始.
+func (c *collector) openReadOnly() {
+	registrar, err := loadRegistrarFile(c.registrarFile)
+	if err != nil {
+		logp.Warn("%s collector: can not read registrar, starting without it: %v", c.name, err)
+		registrar = map[string]map[string]*fileState{}
+	}
+	c.backend, c.registrar = nopRegistrar{}, registrar
+}
+
 // Run starts lsbeat.
 func (bt *lsbeat) Run(b *beat.Beat) error {
 	logp.Info("lsbeat is running! Hit CTRL-C to stop it.")
+	if shard := bt.config.Shard; shard.Count > 1 {
+		logp.Info("collecting the directories of shard %d of %d", shard.Index, shard.Count)
+	}
 
-	var err error
-	bt.client, err = b.Publisher.Connect()
-	if err != nil {
+	if err := bt.openCollectors(); err != nil {
 		return err
 	}
+	defer bt.shutdown()
+
+	bt.pipeline = b.Publisher
+	for _, c := range bt.collectors {
+		if err := bt.connect(c); err != nil {
+			return err
+		}
+	}
+	if bt.reloader != nil {
+		go bt.reloader.Run(&collectorFactory{bt: bt, info: b.Info})
+	}
+
+	if bt.runOnce {
+		// 只采集一遍, 关闭时等待所有事件被确认
+		failed := filesFailed.Get()
+		bt.collectOnce(b)
+		n := int(filesFailed.Get() - failed)
+		// 没有写完的文件这一次不会再采集了, 也算作失败
+		for fullPath, u := range bt.unfinished {
+			logp.Warn("%s collector: file %s not collected: %s", u.c.name, fullPath, u.reason)
+			n++
+		}
+		if n > 0 {
+			return fmt.Errorf("%d files failed to be collected", n)
+		}
+		return nil
+	}
 
 	ticker := time.NewTicker(bt.config.Period)
+	defer ticker.Stop()
 
 	cnt := bt.config.Cycles
-	list_path := []string{}
-	log_path := []string{}
 	for {
 		select {
-		case <-bt.done:
+		case <-bt.ctx.Done():
 			return nil
 		case <-ticker.C:
 		}
 
 		cnt += 1
-
-		if cnt >= bt.config.Cycles {
+		discover := cnt >= bt.config.Cycles
+		if discover {
 			cnt = 0
-			// 搜索一遍所有的 list 目录和 LOG 目录
-			list_path = findDirectories(bt.config.Path, "list")
-			log_path = findDirectories(bt.config.Path, "LOG")
 		}
+		bt.cycle(b, discover)
+	}
+}
 
-		// 移除掉已经不存在的条目
-		existingDirectories := []string{}
-		for _, dir := range list_path {
-			if _, err := os.Stat(dir); err == nil {
-				// 目录存在，将其添加到新的目录列表中
-				existingDirectories = append(existingDirectories, dir)
+// openCollectors 锁定 registrar 所在的目录, 然后打开各个采集器的 registrar
+func (bt *lsbeat) openCollectors() error {
+	for i, c := range bt.collectors {
+		if bt.reingest != nil && bt.reingest.SkipRegistrar {
+			// 不更新 registrar 时不锁定, 也不升级或迁移, 只读地加载
+			c.openReadOnly()
+			continue
+		}
+		err := c.checkPaths(true)
+		if err == nil {
+			err = bt.lockRegistrar(c)
+		}
+		if err == nil {
+			err = c.open()
+		}
+		if err != nil {
+			for _, c := range bt.collectors[:i] {
+				c.backend.close()
 			}
+			bt.unlockRegistrars()
+			return err
 		}
-		list_path = existingDirectories
+		bt.resumeAfterCollect(c)
+		c.removeOrphanSnapshots()
+	}
+	bt.updateRegistrarEntries()
+	return nil
+}
+
+// lockRegistrar 锁定采集器的 registrar 所在的目录, 已经锁定过的目录直接返回
+func (bt *lsbeat) lockRegistrar(c *collector) error {
+	dir := filepath.Dir(c.registrarFile.path)
+	if _, ok := bt.locks[dir]; ok {
+		return nil
+	}
+	lock, err := lockRegistrarDir(dir)
+	if err != nil {
+		return err
+	}
+	bt.locks[dir] = lock
+	return nil
+}
 
-		existingDirectories = []string{}
-		for _, dir := range log_path {
+func (bt *lsbeat) unlockRegistrars() {
+	for dir, lock := range bt.locks {
+		lock.unlock()
+		delete(bt.locks, dir)
+	}
+}
+
+func (bt *lsbeat) connect(c *collector) error {
+	clientConfig := c.clientConfig
+	var ackers []beat.ACKer
+	if c.config.AfterCollect.Action != afterCollectNone {
+		// 确认之后才会删除或移动文件, 因此事件不能被丢弃
+		clientConfig.PublishMode = beat.GuaranteedSend
+		ackers = append(ackers, acker.EventPrivateReporter(bt.onACK))
+	}
+	if bt.runOnce {
+		// 只采集一遍时由 waitACKs 等待事件被确认, 被停止时可以不再等待
+		ackers = append(ackers, acker.Counting(bt.pending.acked))
+	} else {
+		// 关闭时最多等待这么久, 让已经发送的事件被确认
+		clientConfig.WaitClose = bt.config.ShutdownTimeout
+	}
+	if len(ackers) > 0 {
+		clientConfig.ACKHandler = acker.Combine(ackers...)
+	}
+
+	client, err := bt.pipeline.ConnectWith(clientConfig)
+	if err != nil {
+		return err
+	}
+	if bt.runOnce {
+		client = &countingClient{Client: client, pending: &bt.pending}
+	}
+	// Stop 时 collect 在文件之间停止, client 由 shutdown 关闭.
+	// 只有 Publish 被阻塞时才立即关闭, 没有发送完的文件会被回滚.
+	sc := &stoppableClient{Client: client}
+	c.client = sc
+	go func() {
+		<-bt.ctx.Done()
+		sc.stop()
+	}()
+	return nil
+}
+
+// cycle 采集一轮, discover 为 true 时先重新查找所有的目录
+func (bt *lsbeat) cycle(b *beat.Beat, discover bool) {
+	bt.writers = nil
+	bt.unfinished = nil
+	bt.runAfterCollect()
+	bt.applyCollectorChanges()
+	start := time.Now()
+	collected := filesCollected.Get()
+
+	walkStart := time.Now()
+	walked := false
+	for _, c := range bt.collectors {
+		if !discover && c.discovered {
+			continue
+		}
+		// 搜索一遍所有的 list 目录和 LOG 目录, 新启动的采集器不等到下一次查找
+		c.dirs = findDirectories(bt.ctx, c.paths, c.dirName, bt.config.Shard, func(path string, err error) {
+			bt.reportError(c, opWalk, path, err)
+		})
+		c.discovered = true
+		walked = true
+		if bt.ctx.Err() != nil {
+			// 查找被打断, 结果不完整
+			continue
+		}
+		// 上一次查找之后被删除的目录不会再出现在 c.dirs 中
+		modified := false
+		for _, dir := range removedDirectories(c, c.dirs, bt.config.Shard) {
+			if bt.forgetDirectory(c, dir, time.Now()) {
+				modified = true
+			}
+		}
+		if modified {
+			bt.saveRegistrar(c)
+		}
+	}
+	if walked {
+		walkDuration.Set(sinceMillis(walkStart))
+	}
+
+	for _, c := range bt.collectors {
+		// 移除掉已经不存在的条目
+		existingDirectories := []string{}
+		for _, dir := range c.dirs {
 			if _, err := os.Stat(dir); err == nil {
 				// 目录存在，将其添加到新的目录列表中
 				existingDirectories = append(existingDirectories, dir)
+			} else if os.IsNotExist(err) && bt.forgetDirectory(c, dir, time.Now()) {
+				// 目录下的文件都被删除了
+				bt.saveRegistrar(c)
 			}
 		}
-		log_path = existingDirectories
+		c.dirs = existingDirectories
+	}
 
-		// 采集 list 文件
-		for _, p := range list_path {
-			// 记得测试一下目录是否存在
-			bt.collectList(p, b)
-		}
-		// 采集 log 文件
-		for _, p := range log_path {
-			bt.collectLog(p, b)
+	dirs := 0
+	for _, c := range bt.collectors {
+		dirs += len(c.dirs)
+	}
+	directoriesDiscovered.Set(int64(dirs))
+
+	// 依次采集 list 文件和 log 文件
+	for _, c := range bt.collectors {
+		for _, p := range c.dirs {
+			if bt.ctx.Err() != nil {
+				break
+			}
+			bt.collect(c, p, b)
 		}
+	}
 
-		logp.Info("Event sent")
+	cycleDuration.Set(sinceMillis(start))
+	if n := filesCollected.Get() - collected; n > 0 {
+		logp.Info("%d files collected from %d directories in %v", n, dirs, time.Since(start))
+	} else {
+		logp.Debug("lsbeat", "no file collected from %d directories", dirs)
 	}
 }
 
 // Stop stops lsbeat.
 func (bt *lsbeat) Stop() {
-	bt.client.Close()
-	close(bt.done)
+	bt.stopTime = time.Now()
+	bt.cancel()
 }
 
-// 查找所有的 list 目录
-func findDirectories(roots []string, target string) []string {
+// shutdown 在 Run 退出前执行: 关闭 client 并等待 ack, 然后写入 registrar
+func (bt *lsbeat) shutdown() {
+	logp.Info("lsbeat is stopping, waiting up to %v for pending events", bt.config.ShutdownTimeout)
+	if bt.reloader != nil {
+		bt.reloader.Stop()
+	}
+	if bt.runOnce {
+		bt.waitACKs()
+	}
+	bt.closeClients()
+	// 关闭期间确认的文件也执行 after_collect
+	bt.runAfterCollect()
+	for _, c := range bt.collectors {
+		bt.saveRegistrar(c)
+		if err := c.backend.compact(); err != nil {
+			logp.Err("%s collector: can not compact registrar: %v", c.name, err)
+		}
+		if err := c.backend.close(); err != nil {
+			logp.Err("%s collector: can not close registrar: %v", c.name, err)
+		}
+	}
+	bt.unlockRegistrars()
+}
+
+// closeClients 同时关闭所有的 client. 从 Stop 开始总共最多等待 shutdown_timeout,
+// 而不是每个采集器各等一次, Stop 时 pipeline 已经开始关闭的 client 也算在内.
+func (bt *lsbeat) closeClients() {
+	var wg sync.WaitGroup
+	for _, c := range bt.collectors {
+		if c.client == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(client beat.Client) {
+			defer wg.Done()
+			// 设置了 WaitClose 时会阻塞到所有事件都被确认或者超时
+			client.Close()
+		}(c.client)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if bt.runOnce || bt.config.ShutdownTimeout <= 0 {
+		// 没有设置 WaitClose, 关闭时不会等待
+		<-done
+		return
+	}
+
+	start := time.Now()
+	if bt.ctx.Err() != nil {
+		start = bt.stopTime
+	}
+	timer := time.NewTimer(time.Until(start.Add(bt.config.ShutdownTimeout)))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logp.Warn("shutdown_timeout reached, pending events are not acknowledged")
+	}
+}
+
+// 查找所有的 list 目录, 无法访问的目录会被跳过并通过 onError 报告.
+// 配置了 shard 时只返回分配给当前实例的目录.
+func findDirectories(ctx context.Context, roots []string, target string, shard config.ShardConfig, onError func(path string, err error)) []string {
 	var directories []string
 
 	for _, root := range roots {
 		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
 			if err != nil {
-				return err
+				onError(path, err)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			}
 
 			if info.IsDir() && info.Name() == target {
-				directories = append(directories, path)
+				if rel, err := filepath.Rel(root, path); err == nil && ownsDirectory(shard, rel) {
+					directories = append(directories, path)
+				}
 			}
 			return nil
 		})
@@ -163,202 +684,370 @@ func findDirectories(roots []string, target string) []string {
 	return directories
 }
 
-func (bt *lsbeat) collectList(listDir string, b *beat.Beat) {
+// 采集目录下所有后缀匹配的文件
+func (bt *lsbeat) collect(c *collector, dir string, b *beat.Beat) {
 	now := time.Now()
 	modified := false
 
-	// 采集 list 目录下的所有 list 文件
-	files, err := os.ReadDir(listDir)
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		logp.Err("can not open dir %s", listDir)
+		bt.reportError(c, opReadDir, dir, err)
 	} else {
+		if c.config.LifecycleEvents {
+			modified = bt.publishLifecycle(c, dir, files, now)
+		} else {
+			modified = c.forgetMissing(dir, files)
+		}
 		for _, file := range files {
-			if !file.IsDir() && filepath.Ext(file.Name()) == ".list" {
+			if bt.ctx.Err() != nil {
+				// 正在停止, 剩下的文件下次启动后再采集
+				break
+			}
+			if !file.IsDir() && filepath.Ext(file.Name()) == c.ext {
+				filesScanned.Inc()
 				info, err := file.Info()
 				if err != nil {
-					logp.Err("can not info file %s", file.Name())
+					// 文件可能已经被删除了
+					bt.reportError(c, opStat, filepath.Join(dir, file.Name()), err)
+					filesFailed.Inc()
+					continue
 				}
 				modTime := info.ModTime()
-				last := bt.list_collect_time(listDir, file.Name())
-
-				if last == nil || last.Before(modTime) {
-					bt.sendList(listDir, file.Name(), b, modTime)
+				state := c.state(dir, file.Name())
+
+				if c.shouldCollect(state, modTime, now) {
+					if !bt.writeFinished(c, dir, info, now) {
+						// 还在写入, 下一轮再看
+						filesSkipped.Inc()
+						continue
+					}
+					bt.send(c, dir, info, b)
 					modified = true
 				}
 			}
 		}
 	}
 	if modified {
-		saveRegistrar(bt.config.RegistrarListPath, bt.registrar_list)
+		bt.saveRegistrar(c)
 	}
 	bt.lastIndexTime = now
 }
 
-func (bt *lsbeat) collectLog(logDir string, b *beat.Beat) {
-	now := time.Now()
-	modified := false
-
-	// 采集 list 目录下的所有 list 文件
-	files, err := os.ReadDir(logDir)
-	if err != nil {
-		logp.Err("can not open dir %s", logDir)
-	} else {
-		for _, file := range files {
-			if !file.IsDir() && filepath.Ext(file.Name()) == ".log" {
-				info, err := file.Info()
-				if err != nil {
-					logp.Err("can not info file %s", file.Name())
-				}
-				modTime := info.ModTime()
-				last := bt.log_collect_time(logDir, file.Name())
-
-				if last == nil || last.Before(modTime) {
-					bt.sendLog(logDir, file.Name(), b, modTime)
-					modified = true
-				}
-			}
-		}
-	}
-	if modified {
-		saveRegistrar(bt.config.RegistrarLogPath, bt.registrar_log)
+func (c *collector) state(path string, filename string) *fileState {
+	value, ok := c.registrar[path]
+	if ok {
+		return value[filename]
 	}
-	bt.lastIndexTime = now
+	return nil
 }
 
-func (bt *lsbeat) list_collect_time(path string, filename string) *time.Time {
-	// 获取 list 文件的采集时间
-	value, ok := bt.registrar_list[path]
+// 更新 registrar 中文件的状态, 返回新的状态
+func (c *collector) setState(path string, filename string, state *fileState) *fileState {
+	value, ok := c.registrar[path]
 	if ok {
-		v, o := value[filename]
-		if o {
-			return &v
+		// 键存在, 将 filename 添加到 value 中
+		value[filename] = state
+	} else {
+		// 键不存在
+		c.registrar[path] = map[string]*fileState{
+			filename: state,
 		}
 	}
-	return nil
+	return state
 }
-func (bt *lsbeat) log_collect_time(path string, filename string) *time.Time {
-	// 获取 list 文件的采集时间
-	value, ok := bt.registrar_log[path]
-	if ok {
-		v, o := value[filename]
-		if o {
-			return &v
+
+// restoreState 恢复文件这一次采集前的状态, 没有发送完的文件下次重新采集
+func (c *collector) restoreState(path string, filename string, prev *fileState) {
+	if prev != nil {
+		c.setState(path, filename, prev)
+		return
+	}
+	if files, ok := c.registrar[path]; ok {
+		delete(files, filename)
+		if len(files) == 0 {
+			delete(c.registrar, path)
 		}
 	}
-	return nil
+}
+
+// fileState.Skipped 的取值, 记录文件没有被发送的原因
+const (
+	skipBinary   = "binary"
+	skipTooLarge = "too-large"
+)
+
+// tooLarge 判断文件是否超过了 max_bytes
+func (c *collector) tooLarge(info os.FileInfo) bool {
+	return c.config.MaxBytes > 0 && uint64(info.Size()) > uint64(c.config.MaxBytes)
 }
 
 // 这后边的代码应该没什么问题
-// 发送 list 文件
-func (bt *lsbeat) sendList(path string, filename string, b *beat.Beat, modtime time.Time) {
+// 发送文件
+func (bt *lsbeat) send(c *collector, path string, info os.FileInfo, b *beat.Beat) {
 	now := time.Now()
+	filename := info.Name()
+	modtime := info.ModTime()
 
-	// 更新 registrar
-	value, ok := bt.registrar_list[path]
-	if ok {
-		// 键存在, 将 filename 添加到 value 中
-		value[filename] = now
-	} else {
-		// 键不存在
-		bt.registrar_list[path] = map[string]time.Time{
-			filename: now,
-		}
+	prev := c.state(path, filename)
+	action := actionModified
+	if prev == nil || prev.CollectedTime.IsZero() {
+		action = actionCreated
 	}
 
+	// 更新 registrar
+	state := c.setState(path, filename, &fileState{
+		CollectedTime: now,
+		ModTime:       modtime,
+		Size:          info.Size(),
+		Inode:         fileInode(info),
+	})
+
 	fullPath := filepath.Join(path, filename)
+	if c.tooLarge(info) {
+		// 和二进制文件一样记录到 registrar 中, 文件不变的话下次就不会再检查了
+		logp.Warn("skip file %s, its size %d exceeds max_bytes %d", fullPath, info.Size(), c.config.MaxBytes)
+		state.Skipped = skipTooLarge
+		filesSkipped.Inc()
+		return
+	}
 	content, err := os.ReadFile(fullPath)
 	if err != nil {
-		logp.Err("can not read file %s", fullPath)
+		bt.reportError(c, opRead, fullPath, err)
+		filesFailed.Inc()
+		c.recordFailure(path, filename, prev, err, now)
 		return
 	}
+	bytesRead.Add(int64(len(content)))
+	hash := contentHash(content)
+	state.Hash = hash
+
+	fields := common.MapStr{
+		"type":     c.name,
+		"filename": filename,
+		"path":     fullPath,
+		"modtime":  modtime,
+		"hash":     hash,
+		"event": common.MapStr{
+			"action":   action,
+			"ingested": now,
+		},
+	}
+	if bt.reingest != nil {
+		fields.Put("event.reingest", true)
+	}
+	// 事件的时间, 默认为采集时间
+	timestamp := now
+
+	enc := resolveEncoding(content, c.config.Encoding)
+	if isBinary(content, enc, c.config.BinaryThreshold) {
+		switch c.config.BinaryPolicy {
+		case binarySkip:
+			// 记录到 registrar 中, 文件不变的话下次就不会再检查了
+			logp.Info("skip binary file %s", fullPath)
+			state.Skipped = skipBinary
+			filesSkipped.Inc()
+			return
+		case binaryBase64:
+			fields["content_base64"] = base64.StdEncoding.EncodeToString(content)
+		}
+		fields["binary"] = true
+		fields["size"] = len(content)
+		timestamp = bt.fileTimestamp(c, fullPath, modtime, "", now)
+	} else {
+		// 转换为 UTF-8, 非法字节会被替换并计数
+		text, enc, invalid, err := decodeContent(content, enc)
+		if err != nil {
+			bt.reportError(c, opDecode, fullPath, err)
+			filesFailed.Inc()
+			c.recordFailure(path, filename, prev, err, now)
+			return
+		}
+		if invalid > 0 {
+			logp.Warn("%d invalid characters replaced in file %s (encoding %s)", invalid, fullPath, enc)
+			fields["invalid_chars"] = invalid
+		}
+		fields["encoding"] = enc
+		timestamp = bt.fileTimestamp(c, fullPath, modtime, text, now)
+
+		if c.parser != nil {
+			// 每行一个事件
+			// 每行的 _id 由行的偏移和行内容的哈希生成, 文件追加内容时已有的行 _id 不变
+			var events []beat.Event
+			offset := 0
+			for i, line := range strings.Split(text, "\n") {
+				lineOffset := offset
+				offset += len(line) + 1
+				line = strings.TrimSuffix(line, "\r")
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				record := fields.Clone()
+				record["line"] = i + 1
+				event := c.parser.record(line, record, timestamp)
+				setDocumentID(c, &event, fullPath, contentHash([]byte(line)), strconv.Itoa(lineOffset))
+				events = append(events, event)
+			}
+			if !bt.publishFile(c, path, info, state, events) {
+				c.restoreState(path, filename, prev)
+			}
+			return
+		}
 
-	// 直接将文件内容发送过去即可
+		sendContent := true
+		if c.config.Diff.Mode != diffNone && bt.addDiff(c, fullPath, text, fields) {
+			// 有差异时可以只发送差异
+			sendContent = c.config.Diff.Content
+		}
+		if sendContent {
+			fields["content"] = text
+		}
+	}
 	event := beat.Event{
-		Timestamp: now,
-		Fields: common.MapStr{
-			"type":     "list",
-			"filename": filename,
-			"path":     fullPath,
-			"modtime":  modtime,
-			"content":  string(content),
-		},
+		Timestamp: timestamp,
+		Fields:    fields,
+	}
+	setDocumentID(c, &event, fullPath, hash, "0")
+	if !bt.publishFile(c, path, info, state, []beat.Event{event}) {
+		c.restoreState(path, filename, prev)
 	}
-	bt.client.Publish(event)
 }
 
-// 发送 log 文件
-func (bt *lsbeat) sendLog(path string, filename string, b *beat.Beat, modtime time.Time) {
-	now := time.Now()
-
-	// 更新 registrar
-	value, ok := bt.registrar_log[path]
-	if ok {
-		// 键存在, 将 filename 添加到 value 中
-		value[filename] = now
-	} else {
-		// 键不存在
-		bt.registrar_log[path] = map[string]time.Time{
-			filename: now,
-		}
+// addDiff 和上一次采集时的快照比较, 把差异放到 diff 字段中, 并更新快照.
+// 没有快照或者变化太多时返回 false.
+func (bt *lsbeat) addDiff(c *collector, fullPath string, text string, fields common.MapStr) bool {
+	old, ok := c.loadSnapshot(fullPath)
+	if err := c.saveSnapshot(fullPath, text); err != nil {
+		logp.Err("can not save snapshot of file %s: %v", fullPath, err)
+	}
+	if !ok {
+		return false
 	}
 
-	fullPath := filepath.Join(path, filename)
-	content, err := os.ReadFile(fullPath)
-	if err != nil {
-		logp.Err("can not read file %s", fullPath)
-		return
+	diff := contentDiff(c.config.Diff.Mode, filepath.Base(fullPath), old, text, c.config.Diff.Context)
+	if diff == nil {
+		logp.Debug("lsbeat", "too many changes in file %s, sending the full content", fullPath)
+		return false
 	}
+	fields["diff"] = diff
+	return true
+}
 
-	// 直接将文件内容发送过去即可
-	event := beat.Event{
-		Timestamp: now,
-		Fields: common.MapStr{
-			"type":     "log",
-			"filename": filename,
-			"path":     fullPath,
-			"modtime":  modtime,
-			"content":  string(content),
-		},
+// 计算事件的 @timestamp, 解析失败时使用采集时间
+func (bt *lsbeat) fileTimestamp(c *collector, fullPath string, modtime time.Time, content string, now time.Time) time.Time {
+	ts, err := c.timestamp.timestamp(filepath.Base(fullPath), modtime, content, now)
+	if err != nil {
+		logp.Warn("can not get timestamp of file %s from %s: %v", fullPath, c.timestamp.source, err)
+		return now
 	}
-	bt.client.Publish(event)
+	return ts
 }
 
 type item struct {
-	Path  string      `json:"path"`
-	Files []childItem `json:"files"`
+	// 目录所在的根目录, 为空时 path 是绝对路径
+	Root  *registrarRoot `json:"root,omitempty"`
+	Path  string         `json:"path"`
+	Files []childItem    `json:"files"`
 }
 
 type childItem struct {
-	Filename      string    `json:"filename"`
+	Filename string `json:"filename"`
+	fileState
+}
+
+// 文件在 registrar 中记录的状态
+type fileState struct {
 	CollectedTime time.Time `json:"collected_time"`
+
+	// 跳过采集的原因, 比如 binary, 为空表示正常采集
+	Skipped string `json:"skipped,omitempty"`
+
+	// 采集时文件的元数据, 用于发现删除和重命名
+	ModTime time.Time `json:"modtime"`
+	Size    int64     `json:"size"`
+	Inode   uint64    `json:"inode,omitempty"`
+	// 内容的 sha256
+	Hash string `json:"hash,omitempty"`
+
+	// 连续失败的次数, 最后一次的错误, 下一次重试的时间以及被隔离的时间
+	Failures    int        `json:"failures,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+	Quarantined *time.Time `json:"quarantined,omitempty"`
+
+	// after_collect 的进度: sent 表示还没有被确认, acked 表示动作还没有执行成功
+	AfterCollect string `json:"after_collect,omitempty"`
+	// 上次退出前没有被确认, 需要重新发送, 不写入 registrar
+	resend bool
+}
+
+// 保存采集器的 registrar, 同时更新相关的指标
+func (bt *lsbeat) saveRegistrar(c *collector) {
+	start := time.Now()
+	if err := c.backend.save(c.registrar); err != nil {
+		bt.reportError(c, opSaveRegistrar, c.registrarFile.path, err)
+	}
+	registrarSaveDuration.Set(sinceMillis(start))
+	registrarWrites.Inc()
+	bt.updateRegistrarEntries()
+}
+
+func (bt *lsbeat) updateRegistrarEntries() {
+	entries := 0
+	for _, c := range bt.collectors {
+		for _, files := range c.registrar {
+			entries += len(files)
+		}
+	}
+	registrarEntries.Set(int64(entries))
 }
 
-func loadRegistrar(registrarPath string) map[string]map[string]time.Time {
+// loadRegistrar 读取 JSON 格式的 registrar, 文件不存在时返回空的 registrar.
+// 旧版本的文件会被升级并写回, 调用者需要持有 registrar 目录的锁.
+func loadRegistrar(registrarPath string, paths registrarPaths) (map[string]map[string]*fileState, error) {
+	return readRegistrar(registrarPath, paths, true)
+}
+
+func readRegistrar(registrarPath string, paths registrarPaths, upgrade bool) (map[string]map[string]*fileState, error) {
 	// 加载文件采集的数据
 
-	m := map[string]map[string]time.Time{}
-	content, err := os.ReadFile(registrarPath)
-	if err != nil {
-		return m
+	m := map[string]map[string]*fileState{}
+	entries, err := readRegistrarFile(registrarPath, paths, upgrade)
+	if err != nil || entries == nil {
+		return m, err
 	}
 	var items []item
-	err = json.Unmarshal(content, &items)
-	if err != nil {
-		return m
+	if err := json.Unmarshal(entries, &items); err != nil {
+		return m, fmt.Errorf("invalid registrar %s: %w", registrarPath, err)
 	}
 
+	rewritten := 0
 	for _, item := range items {
-		childitem := map[string]time.Time{}
+		dir, rewrittenItem, ok := paths.dir(item.Root, item.Path)
+		if !ok {
+			logp.Warn("directory %s in registrar %s is ignored, path has no root %s", item.Path, registrarPath, item.Root)
+			continue
+		}
+		if rewrittenItem {
+			rewritten++
+		}
+		childitem, exists := m[dir]
+		if !exists {
+			childitem = map[string]*fileState{}
+			m[dir] = childitem
+		}
 		for _, child := range item.Files {
-			childitem[child.Filename] = child.CollectedTime
+			state := child.fileState
+			childitem[child.Filename] = &state
 		}
-		m[item.Path] = childitem
+	}
+	if rewritten > 0 {
+		logp.Info("%d directories in registrar %s rewritten by path_rewrite", rewritten, registrarPath)
 	}
 
-	return m
+	return m, nil
 }
 
-func saveRegistrar(registrarPath string, m map[string]map[string]time.Time) {
+func saveRegistrar(registrarPath string, m map[string]map[string]*fileState, paths registrarPaths) error {
 	// 首先判断目录是否存在
 
 	// 获取路径的目录部分
@@ -366,32 +1055,24 @@ func saveRegistrar(registrarPath string, m map[string]map[string]time.Time) {
 	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
 		err = os.MkdirAll(dir, 0755)
 		if err != nil {
-			logp.Err("can not mkdir %s", dir)
-			return
+			return fmt.Errorf("can not mkdir %s: %w", dir, err)
 		}
 	}
 
-	file, err := os.Create(registrarPath)
-	if err != nil {
-		logp.Err("can not open file %s", registrarPath)
-		return
-	}
-	defer file.Close()
-
-	var items []item
+	items := []item{}
 	for key, value := range m {
 		var childitems []childItem
 		for key1, value1 := range value {
-			childitems = append(childitems, childItem{Filename: key1, CollectedTime: value1})
+			childitems = append(childitems, childItem{Filename: key1, fileState: *value1})
 		}
-		items = append(items, item{Path: key, Files: childitems})
+		root, rel := paths.key(key)
+		items = append(items, item{Root: root, Path: rel, Files: childitems})
 	}
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(items)
-
+	entries, err := json.Marshal(items)
 	if err != nil {
-		logp.Err("fail to write registrar.")
+		return fmt.Errorf("fail to write registrar: %w", err)
 	}
+	return writeRegistrarFile(registrarPath, entries)
 }
 
 // func (bt *lsbeat) collect(baseDir string, b *beat.Beat) {
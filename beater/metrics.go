@@ -0,0 +1,31 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+// lsbeat 的指标, 通过 HTTP 的 /stats 接口和 monitoring 上报
+var (
+	metrics = monitoring.Default.NewRegistry("lsbeat", monitoring.Report)
+
+	directoriesDiscovered = monitoring.NewInt(metrics, "directories.discovered")
+	walkDuration          = monitoring.NewInt(metrics, "walk.duration.ms")
+
+	filesScanned   = monitoring.NewInt(metrics, "files.scanned")
+	filesCollected = monitoring.NewInt(metrics, "files.collected")
+	filesSkipped   = monitoring.NewInt(metrics, "files.skipped")
+	filesFailed    = monitoring.NewInt(metrics, "files.failed")
+	bytesRead      = monitoring.NewInt(metrics, "bytes.read")
+
+	registrarEntries      = monitoring.NewInt(metrics, "registrar.entries")
+	registrarWrites       = monitoring.NewInt(metrics, "registrar.writes")
+	registrarSaveDuration = monitoring.NewInt(metrics, "registrar.save.duration.ms")
+
+	cycleDuration = monitoring.NewInt(metrics, "cycle.duration.ms")
+)
+
+func sinceMillis(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
@@ -0,0 +1,339 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// 解析失败的记录会带上这个 tag
+const parseFailureTag = "_lsbeat_parse_failure"
+
+// 没有配置 timestamp_field 时依次尝试这些字段
+var defaultTimestampFields = []string{"@timestamp", "timestamp", "time", "ts"}
+
+var defaultTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006/01/02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// 常用的模式, 在 pattern 中通过 %{NAME} 或 %{NAME:field} 引用
+var patternLibrary = map[string]string{
+	"WORD":              `\w+`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"IPV4":              `(?:\d{1,3}\.){3}\d{1,3}`,
+	"HOSTNAME":          `[0-9A-Za-z][0-9A-Za-z.-]*`,
+	"PATH":              `(?:/[^\s/]*)+`,
+	"UUID":              `[0-9A-Fa-f]{8}-(?:[0-9A-Fa-f]{4}-){3}[0-9A-Fa-f]{12}`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|error|err|crit(?:ical)?|fatal|severe|emerg(?:ency)?|alert)`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"SYSLOGTIMESTAMP":   `[A-Z][a-z]{2} +\d{1,2} \d{2}:\d{2}:\d{2}`,
+}
+
+var patternRef = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// 将一行文本解析为字段
+type parser interface {
+	parse(line string) (common.MapStr, error)
+}
+
+// recordParser 按行解析文件内容, 并负责合并字段和提取时间戳
+type recordParser struct {
+	parser
+	config config.ParserConfig
+}
+
+func newParser(c config.ParserConfig) (*recordParser, error) {
+	var p parser
+	switch c.Type {
+	case "":
+		return nil, nil
+	case "ndjson":
+		p = ndjsonParser{}
+	case "logfmt":
+		p = logfmtParser{}
+	case "pattern":
+		re, err := compilePattern(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		p = &patternParser{re: re}
+	default:
+		return nil, fmt.Errorf("unsupported parser type '%s'", c.Type)
+	}
+	return &recordParser{parser: p, config: c}, nil
+}
+
+// 展开 %{NAME:field} 之后编译正则表达式
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("parser.pattern is required for the pattern parser")
+	}
+
+	var err error
+	expanded := patternRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		m := patternRef.FindStringSubmatch(ref)
+		lib, ok := patternLibrary[m[1]]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %%{%s}", m[1])
+			return ref
+		}
+		if m[2] == "" {
+			return "(?:" + lib + ")"
+		}
+		return "(?P<" + m[2] + ">" + lib + ")"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile("^" + expanded + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid parser.pattern: %v", err)
+	}
+	if len(re.SubexpNames()) <= 1 {
+		return nil, fmt.Errorf("parser.pattern has no named captures")
+	}
+	return re, nil
+}
+
+// record 将一行内容转换为事件, 解析失败时保留原始内容并打上 tag
+func (p *recordParser) record(line string, fields common.MapStr, now time.Time) beat.Event {
+	event := beat.Event{
+		Timestamp: now,
+		Fields:    fields,
+	}
+	fields["content"] = line
+
+	parsed, err := p.parse(line)
+	if err != nil {
+		fields["tags"] = []string{parseFailureTag}
+		fields.Put("error.message", err.Error())
+		return event
+	}
+
+	if ts, ok := p.timestamp(parsed); ok {
+		event.Timestamp = ts
+	}
+
+	if p.config.Target != "" {
+		fields.Put(p.config.Target, parsed)
+		return event
+	}
+	for k, v := range parsed {
+		// 这两个字段由 beat.Event 自己维护
+		if k == "@timestamp" || k == "@metadata" {
+			continue
+		}
+		if _, exists := fields[k]; exists && !p.config.OverwriteKeys {
+			continue
+		}
+		fields[k] = v
+	}
+	return event
+}
+
+// 从解析结果中找出记录自己的时间戳
+func (p *recordParser) timestamp(parsed common.MapStr) (time.Time, bool) {
+	keys := defaultTimestampFields
+	if p.config.TimestampField != "" {
+		keys = []string{p.config.TimestampField}
+	}
+	layouts := p.config.TimestampLayouts
+	if len(layouts) == 0 {
+		layouts = defaultTimestampLayouts
+	}
+
+	for _, key := range keys {
+		v, err := parsed.GetValue(key)
+		if err != nil {
+			continue
+		}
+		if ts, ok := parseTimestamp(v, layouts); ok {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseTimestamp 解析记录中的时间戳, 支持字符串和 unix 时间戳 (秒或毫秒)
+func parseTimestamp(v interface{}, layouts []string) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		if ts, ok := parseTimestampLayouts(v, layouts); ok {
+			return ts, true
+		}
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return unixTimestamp(n), true
+		}
+	case float64:
+		return unixTimestamp(v), true
+	case int64:
+		return unixTimestamp(float64(v)), true
+	case int:
+		return unixTimestamp(float64(v)), true
+	}
+	return time.Time{}, false
+}
+
+// parseTimestampLayouts 只按照 layouts 解析, 不把数字当作 unix 时间戳
+func parseTimestampLayouts(v string, layouts []string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if ts, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func unixTimestamp(n float64) time.Time {
+	// 大于这个值的认为是毫秒
+	if n > 1e11 {
+		return time.UnixMilli(int64(n))
+	}
+	sec := int64(n)
+	return time.Unix(sec, int64((n-float64(sec))*1e9))
+}
+
+// 每行一个 JSON 对象
+type ndjsonParser struct{}
+
+func (ndjsonParser) parse(line string) (common.MapStr, error) {
+	// 使用 UseNumber, 否则所有的数字都会变成 float64, 大的整数会丢失精度
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid json: unexpected data after the object")
+	}
+	for k, v := range m {
+		m[k] = convertNumbers(v)
+	}
+	return common.MapStr(m), nil
+}
+
+// convertNumbers 把 json.Number 转换为 int64, 不是整数或者超出范围时转换为 float64
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = convertNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = convertNumbers(child)
+		}
+	}
+	return v
+}
+
+// key=value key2="quoted value" flag
+type logfmtParser struct{}
+
+func (logfmtParser) parse(line string) (common.MapStr, error) {
+	m := common.MapStr{}
+	i := 0
+	for i < len(line) {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("invalid logfmt: empty key at offset %d", start)
+		}
+		if i >= len(line) || line[i] == ' ' {
+			// 没有值的 key
+			m[key] = true
+			continue
+		}
+		i++ // 跳过 '='
+
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("invalid logfmt: unterminated quote for key '%s'", key)
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid logfmt: %v", err)
+			}
+			m[key] = value
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		m[key] = line[start:i]
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("invalid logfmt: no fields")
+	}
+	return m, nil
+}
+
+// 带命名捕获组的正则表达式
+type patternParser struct {
+	re *regexp.Regexp
+}
+
+func (p *patternParser) parse(line string) (common.MapStr, error) {
+	match := p.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("line does not match pattern")
+	}
+	m := common.MapStr{}
+	for i, name := range p.re.SubexpNames() {
+		if name != "" && match[i] != "" {
+			m[name] = match[i]
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,101 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestParsers(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		config config.ParserConfig
+		line   string
+		field  string
+		value  interface{}
+		ts     time.Time
+	}{
+		{
+			name:   "ndjson under target",
+			config: config.ParserConfig{Type: "ndjson", Target: "json"},
+			line:   `{"level":"info","ts":1700000000}`,
+			field:  "json.level",
+			value:  "info",
+			ts:     time.Unix(1700000000, 0),
+		},
+		{
+			// 超过 2^53 的整数不能丢失精度
+			name:   "ndjson integer",
+			config: config.ParserConfig{Type: "ndjson"},
+			line:   `{"id":9007199254740993,"ts":1700000000123}`,
+			field:  "id",
+			value:  int64(9007199254740993),
+			ts:     time.UnixMilli(1700000000123),
+		},
+		{
+			name:   "ndjson nested float",
+			config: config.ParserConfig{Type: "ndjson"},
+			line:   `{"stats":{"ratio":0.5},"time":"2023-12-26T07:37:05Z"}`,
+			field:  "stats.ratio",
+			value:  0.5,
+			ts:     time.Date(2023, 12, 26, 7, 37, 5, 0, time.UTC),
+		},
+		{
+			name:   "logfmt",
+			config: config.ParserConfig{Type: "logfmt"},
+			line:   `time=2023-12-26T07:37:05Z level=warn msg="disk \"a\" full"`,
+			field:  "msg",
+			value:  `disk "a" full`,
+			ts:     time.Date(2023, 12, 26, 7, 37, 5, 0, time.UTC),
+		},
+		{
+			name:   "pattern",
+			config: config.ParserConfig{Type: "pattern", Pattern: `%{TIMESTAMP_ISO8601:timestamp} %{LOGLEVEL:level} %{GREEDYDATA:msg}`},
+			line:   `2023-12-26T07:37:05Z ERROR job failed`,
+			field:  "level",
+			value:  "ERROR",
+			ts:     time.Date(2023, 12, 26, 7, 37, 5, 0, time.UTC),
+		},
+	}
+
+	for _, c := range cases {
+		p, err := newParser(c.config)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		event := p.record(c.line, common.MapStr{}, now)
+		v, err := event.Fields.GetValue(c.field)
+		if err != nil || v != c.value {
+			t.Errorf("%s: %s = %v, want %v", c.name, c.field, v, c.value)
+		}
+		if !event.Timestamp.Equal(c.ts) {
+			t.Errorf("%s: timestamp = %v, want %v", c.name, event.Timestamp, c.ts)
+		}
+	}
+}
+
+func TestParseFailureIsTagged(t *testing.T) {
+	now := time.Now()
+	p, err := newParser(config.ParserConfig{Type: "ndjson"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := p.record("not json", common.MapStr{}, now)
+	if !event.Timestamp.Equal(now) {
+		t.Errorf("timestamp = %v, want collection time", event.Timestamp)
+	}
+	tags, _ := event.Fields["tags"].([]string)
+	if len(tags) != 1 || tags[0] != parseFailureTag {
+		t.Errorf("tags = %v", event.Fields["tags"])
+	}
+	if event.Fields["content"] != "not json" {
+		t.Errorf("content = %v", event.Fields["content"])
+	}
+}
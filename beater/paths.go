@@ -0,0 +1,123 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// relativeToRoot 找到 path 所在的根目录, 返回根目录以及 path 相对于它的路径
+func relativeToRoot(roots []string, path string) (string, string, bool) {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return root, rel, true
+	}
+	return "", "", false
+}
+
+// registrarPaths 在采集时使用的绝对路径和 registrar 中保存的路径之间转换.
+// registrar 中保存根目录的路径和相对于它的路径, path 中增加, 删除根目录或者调整顺序
+// 都不影响已有的条目. 根目录移动了 (比如数据盘挂载到了新的位置) 时由 path_rewrite 改写.
+type registrarPaths struct {
+	roots   []string
+	rewrite []config.PathRewrite
+}
+
+// registrarRoot 是 registrar 中保存的根目录.
+// 版本 2 的 JSON registrar 和当时的 memlog 条目保存的是根目录在 path 中的序号.
+type registrarRoot struct {
+	path  string
+	index *int
+}
+
+func (r registrarRoot) MarshalJSON() ([]byte, error) {
+	if r.index != nil {
+		return json.Marshal(*r.index)
+	}
+	return json.Marshal(r.path)
+}
+
+func (r *registrarRoot) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &r.path); err == nil {
+		r.index = nil
+		return nil
+	}
+	var index int
+	if err := json.Unmarshal(b, &index); err != nil {
+		return fmt.Errorf("invalid root %s", b)
+	}
+	r.path, r.index = "", &index
+	return nil
+}
+
+func (r registrarRoot) String() string {
+	if r.index != nil {
+		return fmt.Sprintf("#%d", *r.index)
+	}
+	return r.path
+}
+
+// key 返回保存到 registrar 中的根目录和相对路径, 不在任何根目录下时根目录为 nil, 路径为绝对路径
+func (p registrarPaths) key(dir string) (*registrarRoot, string) {
+	if root, rel, ok := relativeToRoot(p.roots, dir); ok {
+		return &registrarRoot{path: root}, rel
+	}
+	return nil, dir
+}
+
+// entryKey 是 memlog 中一个文件的 key
+func (p registrarPaths) entryKey(dir, filename string) string {
+	return filepath.Join(dir, filename)
+}
+
+// dir 还原 registrar 中保存的路径, 第一个 bool 表示是否被 path_rewrite 修改过.
+// 按序号保存的根目录超出了 path 的范围时第二个 bool 为 false.
+func (p registrarPaths) dir(root *registrarRoot, rel string) (string, bool, bool) {
+	dir := rel
+	if root != nil {
+		base := root.path
+		if root.index != nil {
+			// 旧版本保存的序号只能按当前的 path 解释, 下一次保存时改为路径
+			if *root.index < 0 || *root.index >= len(p.roots) {
+				return "", false, false
+			}
+			base = p.roots[*root.index]
+		}
+		dir = filepath.Join(base, rel)
+	}
+	for _, r := range p.rewrite {
+		if _, rel, ok := relativeToRoot([]string{r.From}, dir); ok {
+			return filepath.Join(r.To, rel), true, true
+		}
+	}
+	return dir, false, true
+}
+
+// sameRoot 比较两个根目录
+func sameRoot(a, b *registrarRoot) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.index != nil || b.index != nil {
+		return a.index != nil && b.index != nil && *a.index == *b.index
+	}
+	return a.path == b.path
+}
+
+// ownsDirectory 判断目录是否分配给了当前的实例. 使用相对于根目录的路径,
+// 不同主机把 NFS 挂载在不同的位置时分配的结果也相同.
+func ownsDirectory(shard config.ShardConfig, rel string) bool {
+	if shard.Count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.ToSlash(rel)))
+	return int(h.Sum32()%uint32(shard.Count)) == shard.Index
+}
@@ -0,0 +1,69 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestOwnsDirectory(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 1000; i++ {
+		dirs = append(dirs, filepath.Join(fmt.Sprintf("p%d", i), "job", "list"))
+	}
+
+	for _, count := range []int{1, 2, 3, 7} {
+		owned := make([]int, count)
+		for _, rel := range dirs {
+			owners := 0
+			for index := 0; index < count; index++ {
+				if ownsDirectory(config.ShardConfig{Count: count, Index: index}, rel) {
+					owners++
+					owned[index]++
+				}
+			}
+			// 每个目录恰好属于一个实例: 互不相交, 合起来覆盖所有目录
+			if owners != 1 {
+				t.Fatalf("count %d: %s owned by %d instances", count, rel, owners)
+			}
+		}
+		for index, n := range owned {
+			if count > 1 && n == 0 {
+				t.Errorf("count %d: instance %d owns no directory", count, index)
+			}
+		}
+	}
+
+	// 同样的目录树挂载在不同的位置时, 每个实例找到的目录相同
+	roots := []string{filepath.Join(t.TempDir(), "data"), filepath.Join(t.TempDir(), "mnt", "nfs", "data")}
+	for _, root := range roots {
+		for i := 0; i < 50; i++ {
+			if err := os.MkdirAll(filepath.Join(root, fmt.Sprintf("p%d", i), "list"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for index := 0; index < 3; index++ {
+		shard := config.ShardConfig{Count: 3, Index: index}
+		var found [2][]string
+		for i, root := range roots {
+			for _, dir := range findDirectories(context.Background(), []string{root}, "list", shard, func(path string, err error) { t.Error(err) }) {
+				rel, _ := filepath.Rel(root, dir)
+				found[i] = append(found[i], rel)
+			}
+			sort.Strings(found[i])
+		}
+		if len(found[0]) == 0 || !reflect.DeepEqual(found[0], found[1]) {
+			t.Errorf("shard %d: found %v under %s and %v under %s", index, found[0], roots[0], found[1], roots[1])
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// 在 close_write_grace 内被修改, 宽限期结束后就可以采集
+const pendingGrace = "modified within close_write_grace"
+
+// 本轮中还没有写完的文件
+type unfinishedFile struct {
+	c      *collector
+	reason string
+}
+
+// 等待写入完成的文件第一次被观察到时的状态
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// writeFinished 判断文件是否已经写完, 可以采集了.
+// 没有写完的文件记录到 bt.unfinished 中, 只采集一遍时还要再检查.
+func (bt *lsbeat) writeFinished(c *collector, dir string, info os.FileInfo, now time.Time) bool {
+	reason := bt.writePending(c, dir, info, now)
+	if reason == "" {
+		return true
+	}
+	if bt.unfinished == nil {
+		bt.unfinished = map[string]unfinishedFile{}
+	}
+	bt.unfinished[filepath.Join(dir, info.Name())] = unfinishedFile{c: c, reason: reason}
+	return false
+}
+
+// writePending 返回文件还不能采集的原因, 为空表示已经写完.
+// 依次检查标记文件, 是否被其他进程以写方式打开, 以及大小和修改时间是否稳定.
+func (bt *lsbeat) writePending(c *collector, dir string, info os.FileInfo, now time.Time) string {
+	fullPath := filepath.Join(dir, info.Name())
+
+	if c.config.DoneSuffix != "" {
+		if _, err := os.Stat(fullPath + c.config.DoneSuffix); err != nil {
+			return "waiting for " + info.Name() + c.config.DoneSuffix
+		}
+	}
+
+	if c.config.IgnoreOpenFiles {
+		if bt.writers == nil {
+			writers, err := openWriters()
+			if err != nil {
+				logp.Warn("can not list files opened for writing: %v", err)
+			}
+			bt.writers = writers
+		}
+		// /proc 中记录的是绝对路径
+		abs, err := filepath.Abs(fullPath)
+		if err != nil {
+			abs = fullPath
+		}
+		if bt.writers[abs] {
+			logp.Debug("lsbeat", "file %s is still open for writing", fullPath)
+			return "open for writing"
+		}
+	}
+
+	grace := c.config.CloseWriteGrace
+	if grace <= 0 {
+		return ""
+	}
+
+	p, ok := c.pending[fullPath]
+	if !ok || p.size != info.Size() || !p.modTime.Equal(info.ModTime()) {
+		// 第一次见到, 或者又发生了变化, 重新计时.
+		// 修改时间已经足够久远的文件不需要再等.
+		if now.Sub(info.ModTime()) >= grace {
+			delete(c.pending, fullPath)
+			return ""
+		}
+		c.pending[fullPath] = pendingFile{size: info.Size(), modTime: info.ModTime(), since: now}
+		return pendingGrace
+	}
+	if now.Sub(p.since) < grace {
+		return pendingGrace
+	}
+	delete(c.pending, fullPath)
+	return ""
+}
+
+// collectOnce 只采集一遍. 在 close_write_grace 内被修改的文件等宽限期结束后再检查,
+// 直到没有这样的文件或者 lsbeat 被停止. 最后还没有写完的文件留在 bt.unfinished 中.
+func (bt *lsbeat) collectOnce(b *beat.Beat) {
+	bt.unfinished = nil
+	if bt.reingest != nil {
+		bt.reingestFiles(b)
+	} else {
+		bt.cycle(b, true)
+	}
+
+	for bt.ctx.Err() == nil {
+		wait, ok := bt.graceWait(time.Now())
+		if !ok {
+			return
+		}
+		logp.Info("%d files are still being written, checking them again in %v", len(bt.unfinished), wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-bt.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		bt.recheckUnfinished(b)
+	}
+}
+
+// graceWait 返回最早结束的 close_write_grace 还要等多久, 没有这样的文件时返回 false
+func (bt *lsbeat) graceWait(now time.Time) (time.Duration, bool) {
+	var wait time.Duration
+	found := false
+	for fullPath, u := range bt.unfinished {
+		if u.reason != pendingGrace {
+			continue
+		}
+		p, ok := u.c.pending[fullPath]
+		if !ok {
+			continue
+		}
+		d := p.since.Add(u.c.config.CloseWriteGrace).Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		if !found || d < wait {
+			wait, found = d, true
+		}
+	}
+	return wait, found
+}
+
+// recheckUnfinished 再检查一遍还没有写完的文件, 写完的就发送
+func (bt *lsbeat) recheckUnfinished(b *beat.Beat) {
+	unfinished := bt.unfinished
+	bt.unfinished = nil
+	bt.writers = nil
+	now := time.Now()
+	modified := map[*collector]bool{}
+	for fullPath, u := range unfinished {
+		if bt.ctx.Err() != nil {
+			break
+		}
+		if u.c.closed {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			// 写完之前被删除了
+			bt.reportError(u.c, opStat, fullPath, err)
+			filesFailed.Inc()
+			continue
+		}
+		dir := filepath.Dir(fullPath)
+		if !bt.writeFinished(u.c, dir, info, now) {
+			continue
+		}
+		bt.send(u.c, dir, info, b)
+		modified[u.c] = true
+	}
+	for c := range modified {
+		bt.saveRegistrar(c)
+	}
+}
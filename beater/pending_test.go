@@ -0,0 +1,127 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestWritePending(t *testing.T) {
+	const grace = 10 * time.Second
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	type step struct {
+		at     time.Duration // 相对于 start 的检查时间
+		modify bool          // 检查前文件又被写入了, 大小和修改时间都变化
+		touch  bool          // 检查前只有修改时间变化
+		want   string
+	}
+	cases := []struct {
+		name       string
+		grace      time.Duration
+		doneSuffix string
+		done       bool          // 标记文件已经存在
+		open       bool          // 被其他进程以写方式打开
+		age        time.Duration // 第一次检查时文件的修改时间距今多久
+		steps      []step
+	}{
+		{name: "no checks", steps: []step{{at: 0, want: ""}}},
+		{name: "grace", grace: grace, steps: []step{
+			{at: 0, want: pendingGrace},
+			{at: 5 * time.Second, want: pendingGrace},
+			{at: 10 * time.Second, want: ""},
+		}},
+		{name: "change restarts grace", grace: grace, steps: []step{
+			{at: 0, want: pendingGrace},
+			{at: 5 * time.Second, modify: true, want: pendingGrace},
+			{at: 10 * time.Second, want: pendingGrace},
+			{at: 15 * time.Second, want: ""},
+		}},
+		{name: "mtime change restarts grace", grace: grace, steps: []step{
+			{at: 0, want: pendingGrace},
+			{at: 5 * time.Second, touch: true, want: pendingGrace},
+			{at: 10 * time.Second, want: pendingGrace},
+			{at: 15 * time.Second, want: ""},
+		}},
+		{name: "old mtime skips the wait", grace: grace, age: time.Hour, steps: []step{
+			{at: 0, want: ""},
+		}},
+		{name: "done marker missing", doneSuffix: ".done", steps: []step{
+			{at: 0, want: "waiting for 1.list.done"},
+		}},
+		{name: "done marker present", doneSuffix: ".done", done: true, steps: []step{
+			{at: 0, want: ""},
+		}},
+		{name: "done marker before grace", grace: grace, doneSuffix: ".done", done: true, steps: []step{
+			{at: 0, want: pendingGrace},
+			{at: 10 * time.Second, want: ""},
+		}},
+		{name: "open for writing", open: true, grace: grace, age: time.Hour, steps: []step{
+			{at: 0, want: "open for writing"},
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fullPath := filepath.Join(dir, "1.list")
+			write := func(content string, modTime time.Time) os.FileInfo {
+				if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(fullPath, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+				info, err := os.Stat(fullPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return info
+			}
+			info := write("first", start.Add(-tc.age))
+			if tc.done {
+				if err := os.WriteFile(fullPath+tc.doneSuffix, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := config.DefaultCollectorConfig
+			cfg.CloseWriteGrace = tc.grace
+			cfg.DoneSuffix = tc.doneSuffix
+			cfg.IgnoreOpenFiles = true
+			c := &collector{name: "list", config: cfg, pending: map[string]pendingFile{}}
+			// 不读取 /proc, 直接给出被打开的文件
+			bt := &lsbeat{writers: map[string]bool{}}
+			if tc.open {
+				abs, err := filepath.Abs(fullPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bt.writers[abs] = true
+			}
+
+			content := "first"
+			for i, s := range tc.steps {
+				now := start.Add(s.at)
+				if s.modify {
+					content += " more"
+				}
+				if s.modify || s.touch {
+					info = write(content, now)
+				}
+				if got := bt.writePending(c, dir, info, now); got != s.want {
+					t.Errorf("step %d at %v: got %q, want %q", i, s.at, got, s.want)
+				}
+			}
+			if last := tc.steps[len(tc.steps)-1]; last.want == "" && len(c.pending) != 0 {
+				t.Errorf("finished file still pending: %v", c.pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+// registrar_backend 的取值
+const (
+	registrarJSON   = "json"   // 每次保存都重写整个 JSON 文件
+	registrarMemlog = "memlog" // libbeat statestore 的 memlog, 只记录变化的条目
+)
+
+// registrarBackend 负责持久化一个采集器的 registrar.
+// 采集过程中使用内存中的 map, 只在保存时写入存储.
+type registrarBackend interface {
+	load() (map[string]map[string]*fileState, error)
+	// save 写入 m 的当前内容, 支持按条目更新的实现只写入有变化的条目
+	save(m map[string]map[string]*fileState) error
+	// compact 压缩存储占用的空间
+	compact() error
+	close() error
+}
+
+// openRegistrar 打开 path 对应的 registrar, path 是 JSON 格式时的文件名
+func openRegistrar(name string, path string, paths registrarPaths) (registrarBackend, error) {
+	switch name {
+	case registrarJSON:
+		return jsonRegistrar{path: path, paths: paths}, nil
+	case registrarMemlog:
+		return openMemlogRegistrar(path, paths)
+	}
+	return nil, fmt.Errorf("unsupported registrar_backend '%s'", name)
+}
+
+// 只读地加载一个 registrar, 旧版本的 JSON registrar 只在内存中升级, 不写回文件
+func loadRegistrarFile(r registrarFile) (map[string]map[string]*fileState, error) {
+	if r.backend == registrarJSON {
+		return readRegistrar(r.path, r.paths, false)
+	}
+
+	// 还没有 memlog 存储时读取迁移前的 JSON 文件, 不创建存储
+	if _, err := os.Stat(memlogStoreDir(r.path)); os.IsNotExist(err) {
+		return readRegistrar(r.path, r.paths, false)
+	}
+	// 打开 memlog 存储会清理和改写其中的文件, 不能和运行中的 lsbeat 同时进行
+	lock, owner, err := tryLockRegistrarDir(filepath.Dir(r.path), 0)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, fmt.Errorf("lsbeat is running (registrar directory %s is locked by %s), stop it before reading the memlog registrar",
+			filepath.Dir(r.path), owner)
+	}
+	defer lock.unlock()
+
+	backend, err := newMemlogRegistrar(r.path, r.paths)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.close()
+
+	m, err := backend.load()
+	if err != nil {
+		return nil, fmt.Errorf("can not load registrar %s: %v", r.path, err)
+	}
+	if len(m) == 0 {
+		// 存储是空的, 打开时会导入 JSON 文件
+		return readRegistrar(r.path, r.paths, false)
+	}
+	return m, nil
+}
+
+// 原来的格式, 整个 registrar 是一个 JSON 文件
+type jsonRegistrar struct {
+	path  string
+	paths registrarPaths
+}
+
+func (r jsonRegistrar) load() (map[string]map[string]*fileState, error) {
+	return loadRegistrar(r.path, r.paths)
+}
+
+func (r jsonRegistrar) save(m map[string]map[string]*fileState) error {
+	return saveRegistrar(r.path, m, r.paths)
+}
+
+func (jsonRegistrar) compact() error { return nil }
+func (jsonRegistrar) close() error   { return nil }
+
+// JSON registrar 的格式版本. 修改格式时增加版本号, 并在 registrarMigrations 中添加升级的方法.
+const registrarVersion = 3
+
+// JSON registrar 文件的内容, 版本 0 没有这一层, 整个文件就是 entries
+type registrarEnvelope struct {
+	Version int             `json:"version"`
+	Entries json.RawMessage `json:"entries"`
+}
+
+// registrarMigrations[i] 把版本 i 的 entries 升级到版本 i+1
+var registrarMigrations = []func(entries json.RawMessage, paths registrarPaths) (json.RawMessage, error){
+	// 0 -> 1: 只是加上了版本号, entries 的格式没有变化
+	func(entries json.RawMessage, paths registrarPaths) (json.RawMessage, error) {
+		if bytes.Equal(bytes.TrimSpace(entries), []byte("null")) {
+			return json.RawMessage("[]"), nil
+		}
+		return entries, nil
+	},
+	// 1 -> 2: 增加了 root (根目录在 path 中的序号), 原来的条目没有 root, path 是绝对路径,
+	// 保存时再转换为相对路径
+	func(entries json.RawMessage, paths registrarPaths) (json.RawMessage, error) {
+		return entries, nil
+	},
+	// 2 -> 3: root 从序号改为根目录的路径. 序号按当前的 path 转换, 超出范围的保留序号, 读取时被忽略
+	func(entries json.RawMessage, paths registrarPaths) (json.RawMessage, error) {
+		var items []item
+		if err := json.Unmarshal(entries, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			root := items[i].Root
+			if root != nil && root.index != nil && *root.index >= 0 && *root.index < len(paths.roots) {
+				items[i].Root = &registrarRoot{path: paths.roots[*root.index]}
+			}
+		}
+		return json.Marshal(items)
+	},
+}
+
+// readRegistrarFile 读取 JSON registrar 并返回当前版本的 entries, 文件不存在时返回 nil.
+// 旧版本的文件在内存中升级, upgrade 为 true 时 (调用者持有 registrar 目录的锁)
+// 先备份为 <path>.v<版本>.bak, 再写回升级后的内容. 拒绝读取更新的版本,
+// 否则保存时会丢掉旧版本的 lsbeat 不认识的内容.
+func readRegistrarFile(path string, paths registrarPaths, upgrade bool) (json.RawMessage, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		// 写入时被中断
+		logp.Warn("registrar %s is empty", path)
+		return nil, nil
+	}
+
+	env := registrarEnvelope{Entries: content}
+	if bytes.TrimSpace(content)[0] == '{' {
+		if err := json.Unmarshal(content, &env); err != nil {
+			return nil, fmt.Errorf("invalid registrar %s: %w", path, err)
+		}
+	}
+	if env.Version > registrarVersion {
+		return nil, fmt.Errorf("registrar %s has version %d, this lsbeat only supports up to version %d, refusing to downgrade it",
+			path, env.Version, registrarVersion)
+	}
+	if env.Version == registrarVersion {
+		return env.Entries, nil
+	}
+
+	entries := env.Entries
+	for v := env.Version; v < registrarVersion; v++ {
+		if entries, err = registrarMigrations[v](entries, paths); err != nil {
+			return nil, fmt.Errorf("can not migrate registrar %s from version %d: %w", path, v, err)
+		}
+	}
+	if !upgrade {
+		return entries, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, env.Version)
+	if err := os.WriteFile(backup, content, 0600); err != nil {
+		return nil, fmt.Errorf("can not back up registrar %s: %w", path, err)
+	}
+	if err := writeRegistrarFile(path, entries); err != nil {
+		return nil, fmt.Errorf("can not migrate registrar %s: %w", path, err)
+	}
+	logp.Info("registrar %s upgraded from version %d to %d, the old file is kept as %s", path, env.Version, registrarVersion, backup)
+	return entries, nil
+}
+
+// writeRegistrarFile 以当前版本写入 entries, 先写临时文件再重命名, 中断时不会留下不完整的文件
+func writeRegistrarFile(path string, entries json.RawMessage) error {
+	content, err := json.Marshal(registrarEnvelope{Version: registrarVersion, Entries: entries})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// memlog 中每个文件一个条目, key 为文件的完整路径
+type memlogRegistrar struct {
+	registry *memlog.Registry
+	store    backend.Store
+	paths    registrarPaths
+
+	// 上一次保存时各个条目的内容, 用来找出有变化的条目
+	saved map[string]registrarEntry
+}
+
+// 保存在 memlog 中的条目, 和 JSON 格式一样, root 为空时 path 是绝对路径
+type registrarEntry struct {
+	Root *registrarRoot `json:"root,omitempty"`
+	Path string         `json:"path"`
+	childItem
+}
+
+func (e registrarEntry) equal(o registrarEntry) bool {
+	return sameRoot(e.Root, o.Root) && e.Path == o.Path && e.Filename == o.Filename && e.fileState.equal(o.fileState)
+}
+
+// 存储放在 JSON 文件所在的目录下, 目录名为去掉 .json 后缀的文件名
+func memlogStoreDir(path string) string {
+	return strings.TrimSuffix(path, ".json")
+}
+
+// openMemlogRegistrar 打开存储并导入原来的 JSON 文件, 调用者需要持有 registrar 目录的锁
+func openMemlogRegistrar(path string, paths registrarPaths) (*memlogRegistrar, error) {
+	r, err := newMemlogRegistrar(path, paths)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.migrate(path); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newMemlogRegistrar(path string, paths registrarPaths) (*memlogRegistrar, error) {
+	registry, err := memlog.New(logp.NewLogger("registrar"), memlog.Settings{
+		Root:     filepath.Dir(path),
+		FileMode: 0600,
+	})
+	if err != nil {
+		return nil, err
+	}
+	store, err := registry.Access(filepath.Base(memlogStoreDir(path)))
+	if err != nil {
+		registry.Close()
+		return nil, fmt.Errorf("can not open registrar store: %w", err)
+	}
+	return &memlogRegistrar{
+		registry: registry,
+		store:    store,
+		paths:    paths,
+		saved:    map[string]registrarEntry{},
+	}, nil
+}
+
+// migrate 将原来的 JSON 文件导入到空的存储中, 导入后 JSON 文件被重命名为 .migrated
+func (r *memlogRegistrar) migrate(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	m, err := r.load()
+	if err != nil {
+		return err
+	}
+	if len(m) > 0 {
+		logp.Warn("registrar %s is ignored, the store already contains entries", path)
+		return nil
+	}
+
+	m, err = loadRegistrar(path, r.paths)
+	if err != nil {
+		return err
+	}
+	if err := r.save(m); err != nil {
+		return fmt.Errorf("can not migrate registrar %s: %w", path, err)
+	}
+	if err := r.compact(); err != nil {
+		return fmt.Errorf("can not migrate registrar %s: %w", path, err)
+	}
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return fmt.Errorf("can not migrate registrar %s: %w", path, err)
+	}
+	logp.Info("registrar %s migrated to the memlog store", path)
+	return nil
+}
+
+func (r *memlogRegistrar) load() (map[string]map[string]*fileState, error) {
+	m := map[string]map[string]*fileState{}
+	r.saved = map[string]registrarEntry{}
+	rewritten := 0
+	err := r.store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		var entry registrarEntry
+		if err := decodeEntry(dec, &entry); err != nil {
+			logp.Warn("invalid registrar entry %s: %v", key, err)
+			return true, nil
+		}
+
+		dir, rewrittenEntry, ok := r.paths.dir(entry.Root, entry.Path)
+		if !ok {
+			// 下一次保存时删除
+			logp.Warn("registrar entry %s is ignored, path has no root %s", key, entry.Root)
+			r.saved[key] = entry
+			return true, nil
+		}
+		if rewrittenEntry {
+			rewritten++
+		}
+		files, ok := m[dir]
+		if !ok {
+			files = map[string]*fileState{}
+			m[dir] = files
+		}
+		state := entry.fileState
+		files[entry.Filename] = &state
+		// 路径变化了的条目在下一次保存时写入新的 key
+		entry.fileState = state.clone()
+		r.saved[key] = entry
+		return true, nil
+	})
+	if rewritten > 0 {
+		logp.Info("%d registrar entries rewritten by path_rewrite", rewritten)
+	}
+	return m, err
+}
+
+func (r *memlogRegistrar) save(m map[string]map[string]*fileState) error {
+	current := map[string]bool{}
+	for dir, files := range m {
+		for filename, state := range files {
+			key := r.paths.entryKey(dir, filename)
+			current[key] = true
+			root, rel := r.paths.key(dir)
+			entry := registrarEntry{
+				Root:      root,
+				Path:      rel,
+				childItem: childItem{Filename: filename, fileState: *state},
+			}
+			if saved, ok := r.saved[key]; ok && saved.equal(entry) {
+				continue
+			}
+
+			if err := setEntry(r.store, key, entry); err != nil {
+				return fmt.Errorf("can not save registrar entry %s: %w", key, err)
+			}
+			entry.fileState = state.clone()
+			r.saved[key] = entry
+		}
+	}
+
+	for key := range r.saved {
+		if current[key] {
+			continue
+		}
+		if err := r.store.Remove(key); err != nil {
+			return fmt.Errorf("can not remove registrar entry %s: %w", key, err)
+		}
+		delete(r.saved, key)
+	}
+	return nil
+}
+
+// compact 写入一个新的 checkpoint 并清空操作日志.
+// lsbeat 退出时执行一次, 日志超过 10MB 时 memlog 也会自动这样做.
+func (r *memlogRegistrar) compact() error {
+	if s, ok := r.store.(interface{ Checkpoint() error }); ok {
+		return s.Checkpoint()
+	}
+	return nil
+}
+
+func (r *memlogRegistrar) close() error {
+	err := r.store.Close()
+	r.registry.Close()
+	return err
+}
+
+// memlog 中保存的是 common.MapStr, 通过 JSON 转换, 保持和 JSON 格式相同的字段名
+func setEntry(store backend.Store, key string, entry registrarEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	return store.Set(key, value)
+}
+
+func decodeEntry(dec backend.ValueDecoder, entry *registrarEntry) error {
+	var value map[string]interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, entry)
+}
+
+// clone 复制状态, 包括指针指向的时间
+func (s fileState) clone() fileState {
+	if s.NextRetry != nil {
+		t := *s.NextRetry
+		s.NextRetry = &t
+	}
+	if s.Quarantined != nil {
+		t := *s.Quarantined
+		s.Quarantined = &t
+	}
+	return s
+}
+
+func (s fileState) equal(o fileState) bool {
+	return s.CollectedTime.Equal(o.CollectedTime) &&
+		s.Skipped == o.Skipped &&
+		s.ModTime.Equal(o.ModTime) &&
+		s.Size == o.Size &&
+		s.Inode == o.Inode &&
+		s.Hash == o.Hash &&
+		s.Failures == o.Failures &&
+		s.LastError == o.LastError &&
+		timePtrEqual(s.NextRetry, o.NextRetry) &&
+		timePtrEqual(s.Quarantined, o.Quarantined) &&
+		s.AfterCollect == o.AfterCollect
+}
+
+func timePtrEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,353 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestMemlogRegistrarMigrate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registrar-list.json")
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := saveRegistrar(path, map[string]map[string]*fileState{
+		"/data/list": {"1.list": {ModTime: modTime, Size: 10, Hash: "abc"}},
+	}, registrarPaths{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openMemlogRegistrar(path, registrarPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".migrated"); err != nil {
+		t.Errorf("registrar not renamed after migration: %v", err)
+	}
+
+	m, err := r.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := m["/data/list"]["1.list"]
+	if state == nil || !state.ModTime.Equal(modTime) || state.Size != 10 || state.Hash != "abc" {
+		t.Fatalf("migrated state = %+v", state)
+	}
+
+	// 修改一个条目, 删除另一个
+	m["/data/list"]["2.list"] = &fileState{Size: 20}
+	delete(m["/data/list"], "1.list")
+	if err := r.save(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = openMemlogRegistrar(path, registrarPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	m, err = r.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m["/data/list"]) != 1 || m["/data/list"]["2.list"] == nil || m["/data/list"]["2.list"].Size != 20 {
+		t.Errorf("reloaded registrar = %+v", m)
+	}
+}
+
+func TestRegistrarVersionMigrate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registrar-list.json")
+	legacy := `[{"path":"/data/list","files":[{"filename":"1.list","collected_time":"2024-01-02T03:04:05Z","modtime":"2024-01-02T03:04:05Z","size":10}]}]`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读的加载只在内存中升级
+	m, err := loadRegistrarFile(registrarFile{path: path, backend: registrarJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/data/list"]["1.list"]; state == nil || state.Size != 10 {
+		t.Fatalf("read-only state = %+v", state)
+	}
+	if content, _ := os.ReadFile(path); string(content) != legacy {
+		t.Errorf("registrar written by a read-only load: %s", content)
+	}
+	if _, err := os.Stat(path + ".v0.bak"); !os.IsNotExist(err) {
+		t.Errorf("backup written by a read-only load: %v", err)
+	}
+
+	m, err = loadRegistrar(path, registrarPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/data/list"]["1.list"]; state == nil || state.Size != 10 {
+		t.Fatalf("migrated state = %+v", state)
+	}
+	if backup, err := os.ReadFile(path + ".v0.bak"); err != nil || string(backup) != legacy {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env registrarEnvelope
+	if err := json.Unmarshal(content, &env); err != nil || env.Version != registrarVersion {
+		t.Errorf("upgraded registrar = %s, %v", content, err)
+	}
+
+	// 更新的版本不能被读取
+	if err := os.WriteFile(path, []byte(`{"version":99,"entries":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRegistrar(path, registrarPaths{}); err == nil {
+		t.Error("registrar with a newer version loaded")
+	}
+}
+
+func TestRegistrarPathRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrar-list.json")
+	old := registrarPaths{roots: []string{"/home/qiu/listtest"}}
+	if err := saveRegistrar(path, map[string]map[string]*fileState{
+		"/home/qiu/listtest/p1/list": {"1.list": {Size: 10}},
+		"/other/list":                {"2.list": {Size: 20}},
+	}, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据盘挂载到了 /mnt/data 下
+	moved := registrarPaths{
+		roots:   []string{"/mnt/data/listtest"},
+		rewrite: []config.PathRewrite{{From: "/home/qiu", To: "/mnt/data"}},
+	}
+	m, err := loadRegistrar(path, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/mnt/data/listtest/p1/list"]["1.list"]; state == nil || state.Size != 10 {
+		t.Errorf("rewritten registrar = %+v", m)
+	}
+	if state := m["/other/list"]["2.list"]; state == nil || state.Size != 20 {
+		t.Errorf("registrar outside of the roots = %+v", m)
+	}
+}
+
+func TestMemlogRegistrarReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registrar-list.json")
+	r := registrarFile{path: path, backend: registrarMemlog}
+
+	// 没有存储时读取 JSON 文件, 不创建存储
+	if err := saveRegistrar(path, map[string]map[string]*fileState{
+		"/data/list": {"1.list": {Size: 10}},
+	}, registrarPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadRegistrarFile(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/data/list"]["1.list"]; state == nil || state.Size != 10 {
+		t.Fatalf("state = %+v", state)
+	}
+	if _, err := os.Stat(memlogStoreDir(path)); !os.IsNotExist(err) {
+		t.Errorf("store created by a read-only load: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("registrar migrated by a read-only load: %v", err)
+	}
+
+	// 运行中的 lsbeat 持有锁时不打开存储
+	lock, err := lockRegistrarDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := openMemlogRegistrar(path, registrarPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRegistrarFile(r); err == nil {
+		t.Error("memlog registrar loaded while it is locked")
+	}
+	backend.close()
+	lock.unlock()
+
+	m, err = loadRegistrarFile(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/data/list"]["1.list"]; state == nil || state.Size != 10 {
+		t.Fatalf("state = %+v", state)
+	}
+}
+
+func TestRegistrarRoots(t *testing.T) {
+	old := registrarPaths{roots: []string{"/home/qiu/a", "/home/qiu/b"}}
+	for _, backend := range []string{registrarJSON, registrarMemlog} {
+		path := filepath.Join(t.TempDir(), "registrar-list.json")
+		r, err := openRegistrar(backend, path, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.save(map[string]map[string]*fileState{
+			"/home/qiu/a/p1/list": {"1.list": {Size: 10}},
+			"/home/qiu/b/p2/list": {"2.list": {Size: 20}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		r.close()
+
+		load := func(paths registrarPaths) map[string]map[string]*fileState {
+			r, err := openRegistrar(backend, path, paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.close()
+			m, err := r.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+
+		// 插入, 删除根目录或者调整顺序后条目仍然对应原来的目录
+		for _, roots := range [][]string{
+			{"/home/qiu/new", "/home/qiu/b", "/home/qiu/a"},
+			{"/home/qiu/b"},
+		} {
+			m := load(registrarPaths{roots: roots})
+			if state := m["/home/qiu/a/p1/list"]["1.list"]; state == nil || state.Size != 10 {
+				t.Errorf("%s %v: state under the first root = %+v", backend, roots, m)
+			}
+			if state := m["/home/qiu/b/p2/list"]["2.list"]; state == nil || state.Size != 20 {
+				t.Errorf("%s %v: state under the second root = %+v", backend, roots, m)
+			}
+		}
+
+		// 根目录移动后由 path_rewrite 改写
+		m := load(registrarPaths{
+			roots:   []string{"/mnt/data/a", "/mnt/data/b"},
+			rewrite: []config.PathRewrite{{From: "/home/qiu", To: "/mnt/data"}},
+		})
+		if state := m["/mnt/data/a/p1/list"]["1.list"]; state == nil || state.Size != 10 || len(m) != 2 {
+			t.Errorf("%s: rewritten state = %+v", backend, m)
+		}
+	}
+}
+
+func TestRegistrarRootIndex(t *testing.T) {
+	// 版本 2 保存的是根目录的序号, 按当前的 path 转换为路径
+	paths := registrarPaths{roots: []string{"/home/qiu/a", "/home/qiu/b"}}
+	path := filepath.Join(t.TempDir(), "registrar-list.json")
+	v2 := `{"version":2,"entries":[{"root":1,"path":"p2/list","files":[{"filename":"2.list","size":20}]},` +
+		`{"root":5,"path":"p5/list","files":[{"filename":"5.list","size":50}]}]}`
+	if err := os.WriteFile(path, []byte(v2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadRegistrar(path, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/home/qiu/b/p2/list"]["2.list"]; state == nil || state.Size != 20 || len(m) != 1 {
+		t.Errorf("state = %+v", m)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"root":"/home/qiu/b"`) {
+		t.Errorf("upgraded registrar = %s", content)
+	}
+
+	// memlog 中的旧条目在下一次保存时改为新的 key
+	path = filepath.Join(t.TempDir(), "registrar-list.json")
+	r, err := newMemlogRegistrar(path, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := 1
+	if err := setEntry(r.store, "1:p2/list/2.list", registrarEntry{
+		Root:      &registrarRoot{index: &one},
+		Path:      "p2/list",
+		childItem: childItem{Filename: "2.list", fileState: fileState{Size: 20}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = r.load(); err != nil {
+		t.Fatal(err)
+	}
+	if state := m["/home/qiu/b/p2/list"]["2.list"]; state == nil || state.Size != 20 {
+		t.Errorf("memlog state = %+v", m)
+	}
+	if err := r.save(m); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	r.store.Each(func(key string, _ backend.ValueDecoder) (bool, error) {
+		keys = append(keys, key)
+		return true, nil
+	})
+	r.close()
+	if want := filepath.Join("/home/qiu/b/p2/list", "2.list"); len(keys) != 1 || keys[0] != want {
+		t.Errorf("memlog keys = %v, want [%s]", keys, want)
+	}
+}
+
+func TestSkipRegistrarReadOnly(t *testing.T) {
+	legacy := `[{"path":"/data/list","files":[{"filename":"1.list","collected_time":"2024-01-02T03:04:05Z","modtime":"2024-01-02T03:04:05Z","size":10}]}]`
+	for _, backend := range []string{registrarJSON, registrarMemlog} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "registrar-list.json")
+		if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &collector{name: "list", registrarFile: registrarFile{path: path, backend: backend}}
+		bt := &lsbeat{
+			collectors: []*collector{c},
+			locks:      map[string]*registrarLock{},
+			reingest:   &ReingestOptions{SkipRegistrar: true},
+		}
+		if err := bt.openCollectors(); err != nil {
+			t.Fatal(err)
+		}
+		if state := c.state("/data/list", "1.list"); state == nil || state.Size != 10 {
+			t.Errorf("%s: state = %+v", backend, state)
+		}
+		c.setState("/data/list", "2.list", &fileState{Size: 20})
+		bt.saveRegistrar(c)
+		c.backend.close()
+
+		// 没有加锁, 没有升级, 迁移或者写入
+		if len(bt.locks) != 0 {
+			t.Errorf("%s: registrar locked", backend)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			t.Errorf("%s: registrar directory = %v", backend, names)
+		}
+		if content, _ := os.ReadFile(path); string(content) != legacy {
+			t.Errorf("%s: registrar modified: %s", backend, content)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// ReingestOptions 选择需要重新发送的文件
+type ReingestOptions struct {
+	// 文件修改时间的范围, 零值表示不限制
+	Since time.Time
+	Until time.Time
+	// 匹配文件或者它所在的任意一级目录的完整路径
+	PathGlob string
+	// 采集器的名字, 为空表示所有的采集器
+	Collector string
+	// 不更新 registrar
+	SkipRegistrar bool
+}
+
+func (o *ReingestOptions) match(fullPath string, modTime time.Time) bool {
+	if !o.Since.IsZero() && modTime.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && !modTime.Before(o.Until) {
+		return false
+	}
+	if o.PathGlob == "" {
+		return true
+	}
+	for p := fullPath; ; p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(o.PathGlob, p); ok {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// NewReingest 创建一个只运行一遍的 lsbeat, 重新发送匹配的文件.
+// 文件按照正常的采集器配置解析, 事件中带有 event.reingest: true.
+func NewReingest(opts ReingestOptions) beat.Creator {
+	return func(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+		if opts.PathGlob != "" {
+			if _, err := filepath.Match(opts.PathGlob, ""); err != nil {
+				return nil, fmt.Errorf("invalid path glob '%s': %v", opts.PathGlob, err)
+			}
+		}
+
+		bt, err := newLsbeat(b, cfg, true)
+		if err != nil {
+			return nil, err
+		}
+
+		found := opts.Collector == ""
+		for _, c := range bt.collectors {
+			found = found || c.name == opts.Collector
+			// 发送完整的内容, 不删除或移动文件
+			c.config.Diff.Mode = diffNone
+			c.config.AfterCollect.Action = afterCollectNone
+			c.config.LifecycleEvents = false
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown collector '%s'", opts.Collector)
+		}
+
+		bt.reingest = &opts
+		return bt, nil
+	}
+}
+
+// reingestFiles 查找所有匹配的文件并重新发送, 不管 registrar 中的状态
+func (bt *lsbeat) reingestFiles(b *beat.Beat) {
+	start := time.Now()
+	collected := filesCollected.Get()
+
+	for _, c := range bt.collectors {
+		if bt.reingest.Collector != "" && c.name != bt.reingest.Collector {
+			continue
+		}
+		dirs := findDirectories(bt.ctx, c.paths, c.dirName, bt.config.Shard, func(path string, err error) {
+			bt.reportError(c, opWalk, path, err)
+		})
+		for _, dir := range dirs {
+			if bt.ctx.Err() != nil {
+				return
+			}
+			bt.reingestDirectory(c, dir, b)
+		}
+	}
+
+	logp.Info("%d files re-ingested in %v", filesCollected.Get()-collected, time.Since(start))
+}
+
+func (bt *lsbeat) reingestDirectory(c *collector, dir string, b *beat.Beat) {
+	now := time.Now()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		bt.reportError(c, opReadDir, dir, err)
+		return
+	}
+
+	modified := false
+	for _, file := range files {
+		if bt.ctx.Err() != nil {
+			break
+		}
+		if file.IsDir() || filepath.Ext(file.Name()) != c.ext {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			bt.reportError(c, opStat, filepath.Join(dir, file.Name()), err)
+			filesFailed.Inc()
+			continue
+		}
+		if !bt.reingest.match(filepath.Join(dir, file.Name()), info.ModTime()) {
+			continue
+		}
+		if !bt.writeFinished(c, dir, info, now) {
+			logp.Info("%s collector: file %s is still being written, not re-ingested", c.name, filepath.Join(dir, file.Name()))
+			filesSkipped.Inc()
+			continue
+		}
+		bt.send(c, dir, info, b)
+		modified = true
+	}
+	if modified {
+		bt.saveRegistrar(c)
+	}
+}
+
+// nopRegistrar 丢弃所有的修改, 用于不更新 registrar 的 reingest
+type nopRegistrar struct{}
+
+func (nopRegistrar) load() (map[string]map[string]*fileState, error) {
+	return map[string]map[string]*fileState{}, nil
+}
+func (nopRegistrar) save(map[string]map[string]*fileState) error { return nil }
+func (nopRegistrar) compact() error                              { return nil }
+func (nopRegistrar) close() error                                { return nil }
@@ -0,0 +1,260 @@
+package beater
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// collectorsReloadEnabled 判断 config.collectors 是否开启了 reload
+func collectorsReloadEnabled(cfg *common.Config) bool {
+	dc := cfgfile.DefaultDynamicConfig
+	if err := cfg.Unpack(&dc); err != nil {
+		return false
+	}
+	return dc.Reload.Enabled
+}
+
+// loadCollectorDefinitions 读取 config.collectors.path 匹配的所有文件中的采集器.
+// 和 libbeat 的 reloader 一样, 每个文件是一个采集器定义的列表.
+func loadCollectorDefinitions(c config.Config) ([]collectorSpec, error) {
+	if !c.Collectors.Enabled() {
+		return nil, nil
+	}
+	dc := cfgfile.DefaultDynamicConfig
+	if err := c.Collectors.Unpack(&dc); err != nil {
+		return nil, fmt.Errorf("config.collectors: %v", err)
+	}
+	path := dc.Path
+	if !filepath.IsAbs(path) {
+		path = paths.Resolve(paths.Config, path)
+	}
+	files, _, err := cfgfile.NewGlobWatcher(path).Scan()
+	if err != nil {
+		return nil, fmt.Errorf("config.collectors: %v", err)
+	}
+
+	specs := collectorSpecs(c)
+	var defined []collectorSpec
+	for _, file := range files {
+		cfgs, err := cfgfile.LoadList(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, cfg := range cfgs {
+			if !cfg.Enabled() {
+				continue
+			}
+			spec, err := definitionSpec(c, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			for _, other := range specs {
+				if err := conflict(spec, other); err != nil {
+					return nil, fmt.Errorf("%s: %v", file, err)
+				}
+			}
+			specs = append(specs, spec)
+			defined = append(defined, spec)
+		}
+	}
+	return defined, nil
+}
+
+// definitionSpec 解析 lsbeat.d 中的一个采集器定义
+func definitionSpec(c config.Config, cfg *common.Config) (collectorSpec, error) {
+	d, err := config.UnpackCollectorDefinition(cfg)
+	if err != nil && d.Name != "" {
+		return collectorSpec{}, fmt.Errorf("collector %s: %v", d.Name, err)
+	} else if err != nil {
+		return collectorSpec{}, err
+	}
+
+	roots := d.Path
+	if len(roots) == 0 {
+		roots = c.Path
+	}
+	registrar := d.RegistrarPath
+	if registrar == "" {
+		registrar = filepath.Dir(c.RegistrarListPath)
+	}
+	if !strings.HasSuffix(registrar, ".json") {
+		// 需要添加文件名
+		registrar = filepath.Join(registrar, "registrar-"+d.Name+".json")
+	}
+
+	return collectorSpec{
+		name:    d.Name,
+		dirName: d.DirName,
+		ext:     d.Ext,
+		paths:   roots,
+		config:  d.CollectorConfig,
+		registrar: registrarFile{
+			collector: d.Name,
+			path:      registrar,
+			backend:   c.RegistrarBackend,
+			paths:     registrarPaths{roots: roots, rewrite: c.PathRewrite},
+		},
+	}, nil
+}
+
+// 两个采集器不能同名, 也不能共用一个 registrar
+func conflict(a, b collectorSpec) error {
+	if a.name == b.name {
+		return fmt.Errorf("collector %s is defined more than once", a.name)
+	}
+	if a.registrar.path == b.registrar.path {
+		return fmt.Errorf("collectors %s and %s use the same registrar %s", a.name, b.name, a.registrar.path)
+	}
+	return nil
+}
+
+// collectorFactory 供 libbeat 的 reloader 创建 lsbeat.d 中的采集器
+type collectorFactory struct {
+	bt   *lsbeat
+	info beat.Info
+}
+
+func (f *collectorFactory) Create(_ beat.PipelineConnector, cfg *common.Config) (cfgfile.Runner, error) {
+	spec, err := definitionSpec(f.bt.config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCollector(f.info, spec)
+	if err != nil {
+		return nil, err
+	}
+	return &collectorRunner{bt: f.bt, c: c}, nil
+}
+
+func (f *collectorFactory) CheckConfig(cfg *common.Config) error {
+	_, err := f.Create(nil, cfg)
+	return err
+}
+
+// collectorRunner 只把启动和停止交给 Run, 采集器的状态只在 Run 中修改
+type collectorRunner struct {
+	bt *lsbeat
+	c  *collector
+}
+
+// collectorChange 是 reloader 对采集器的一次启动或停止
+type collectorChange struct {
+	c     *collector
+	start bool
+}
+
+func (r *collectorRunner) Start() { r.bt.addCollectorChange(r.c, true) }
+func (r *collectorRunner) Stop()  { r.bt.addCollectorChange(r.c, false) }
+
+func (r *collectorRunner) String() string {
+	return "lsbeat collector " + r.c.name
+}
+
+func (bt *lsbeat) addCollectorChange(c *collector, start bool) {
+	bt.changesMu.Lock()
+	defer bt.changesMu.Unlock()
+	bt.changes = append(bt.changes, collectorChange{c: c, start: start})
+}
+
+// applyCollectorChanges 按顺序启动和停止采集器, 修改一个采集器时 reloader 先停止旧的再启动新的
+func (bt *lsbeat) applyCollectorChanges() {
+	bt.changesMu.Lock()
+	changes := bt.changes
+	bt.changes = nil
+	bt.changesMu.Unlock()
+
+	for _, change := range changes {
+		if change.start {
+			if err := bt.startCollector(change.c); err != nil {
+				logp.Err("can not start collector %s: %v", change.c.name, err)
+			}
+		} else {
+			bt.stopCollector(change.c)
+		}
+	}
+	if len(changes) > 0 {
+		bt.updateRegistrarEntries()
+	}
+}
+
+func (bt *lsbeat) startCollector(c *collector) error {
+	spec := collectorSpec{name: c.name, registrar: c.registrarFile}
+	for _, other := range bt.collectors {
+		if err := conflict(spec, collectorSpec{name: other.name, registrar: other.registrarFile}); err != nil {
+			return err
+		}
+	}
+	if err := c.checkPaths(true); err != nil {
+		return err
+	}
+	if err := bt.lockRegistrar(c); err != nil {
+		return err
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	if err := bt.connect(c); err != nil {
+		c.backend.close()
+		return err
+	}
+	bt.resumeAfterCollect(c)
+	c.removeOrphanSnapshots()
+
+	// 查找的目录没有变化时沿用之前的结果, 不需要重新遍历
+	if prev, ok := bt.stopped[c.name]; ok && prev.dirName == c.dirName && equalPaths(prev.paths, c.paths) {
+		c.dirs, c.discovered = prev.dirs, prev.discovered
+	}
+	delete(bt.stopped, c.name)
+
+	bt.collectors = append(bt.collectors, c)
+	logp.Info("%s collector started, looking for %s directories", c.name, c.dirName)
+	return nil
+}
+
+func (bt *lsbeat) stopCollector(c *collector) {
+	i := 0
+	for i < len(bt.collectors) && bt.collectors[i] != c {
+		i++
+	}
+	if i == len(bt.collectors) {
+		// 没有启动成功
+		return
+	}
+
+	// 等待已经发送的事件被确认, 然后执行 after_collect 并写入 registrar
+	c.client.Close()
+	bt.runAfterCollect()
+	bt.saveRegistrar(c)
+	if err := c.backend.compact(); err != nil {
+		logp.Err("%s collector: can not compact registrar: %v", c.name, err)
+	}
+	if err := c.backend.close(); err != nil {
+		logp.Err("%s collector: can not close registrar: %v", c.name, err)
+	}
+	c.closed = true
+
+	bt.collectors = append(bt.collectors[:i], bt.collectors[i+1:]...)
+	bt.stopped[c.name] = c
+	logp.Info("%s collector stopped", c.name)
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if filepath.Clean(a[i]) != filepath.Clean(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package beater
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// shouldCollect 根据 registrar 中的状态判断文件是否需要采集.
+// 失败过的文件在退避时间到了之后重试, 被隔离的文件只有再次被修改后才会重试.
+func (c *collector) shouldCollect(state *fileState, modTime time.Time, now time.Time) bool {
+	if state == nil || state.resend {
+		return true
+	}
+	if state.Failures > 0 {
+		if state.Quarantined != nil {
+			return modTime.After(*state.Quarantined)
+		}
+		return state.NextRetry == nil || !now.Before(*state.NextRetry)
+	}
+	return state.CollectedTime.Before(modTime)
+}
+
+// recordFailure 记录一次失败, 保留上一次成功采集的状态, 并计算下一次重试的时间.
+// 失败次数超过 max_retries 后文件被隔离, 需要通过 lsbeat quarantine clear 恢复.
+func (c *collector) recordFailure(path, filename string, prev *fileState, err error, now time.Time) {
+	state := &fileState{}
+	if prev != nil {
+		*state = *prev
+	}
+	state.Failures++
+	state.LastError = err.Error()
+
+	if state.Failures > c.config.MaxRetries {
+		state.NextRetry = nil
+		state.Quarantined = &now
+		logp.Warn("%s collector: file %s quarantined after %d failures", c.name, filepath.Join(path, filename), state.Failures)
+	} else {
+		next := now.Add(retryBackoff(c.config.RetryBackoff, c.config.MaxRetryBackoff, state.Failures))
+		state.NextRetry = &next
+	}
+	c.setState(path, filename, state)
+}
+
+// retryBackoff 返回第 failures 次失败后的等待时间, 每次翻倍, 不超过 max.
+// 翻倍前先和 max 比较, 直接移位的话失败次数多时会溢出.
+func retryBackoff(backoff, max time.Duration, failures int) time.Duration {
+	for i := 1; i < failures && backoff < max; i++ {
+		if backoff > max/2 {
+			return max
+		}
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// QuarantinedFile 是因为多次失败被隔离的文件
+type QuarantinedFile struct {
+	Collector   string
+	Path        string
+	Failures    int
+	LastError   string
+	Quarantined time.Time
+}
+
+// ListQuarantined 列出所有被隔离的文件
+func ListQuarantined(cfg *common.Config) ([]QuarantinedFile, error) {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []QuarantinedFile
+	registrars, err := registrarFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range registrars {
+		m, err := loadRegistrarFile(r)
+		if err != nil {
+			return nil, err
+		}
+		for dir, states := range m {
+			for filename, state := range states {
+				if state.Quarantined == nil {
+					continue
+				}
+				files = append(files, QuarantinedFile{
+					Collector:   r.collector,
+					Path:        filepath.Join(dir, filename),
+					Failures:    state.Failures,
+					LastError:   state.LastError,
+					Quarantined: *state.Quarantined,
+				})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// ClearQuarantined 清除隔离状态, 文件会在下一轮重新采集. paths 为空时清除所有的隔离.
+func ClearQuarantined(cfg *common.Config, paths []string) (int, error) {
+	selected := map[string]bool{}
+	for _, p := range paths {
+		selected[p] = true
+	}
+
+	cleared := 0
+	err := modifyRegistrar(cfg, "", func(c *collector, m map[string]map[string]*fileState) bool {
+		modified := false
+		for dir, states := range m {
+			for filename, state := range states {
+				if state.Quarantined == nil || (len(paths) > 0 && !selected[filepath.Join(dir, filename)]) {
+					continue
+				}
+				state.Failures = 0
+				state.LastError = ""
+				state.NextRetry = nil
+				state.Quarantined = nil
+				modified = true
+				cleared++
+			}
+		}
+		return modified
+	})
+	return cleared, err
+}
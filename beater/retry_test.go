@@ -0,0 +1,78 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		backoff, max time.Duration
+		failures     int
+		want         time.Duration
+	}{
+		{time.Minute, time.Hour, 1, time.Minute},
+		{time.Minute, time.Hour, 3, 4 * time.Minute},
+		{time.Minute, time.Hour, 7, time.Hour},
+		{time.Minute, time.Hour, 1000, time.Hour},
+		// 移位会溢出成一个很小的正数
+		{time.Minute, math.MaxInt64, 100, math.MaxInt64},
+		{3 * time.Second, math.MaxInt64, 64, math.MaxInt64},
+	}
+	for _, c := range cases {
+		if got := retryBackoff(c.backoff, c.max, c.failures); got != c.want {
+			t.Errorf("retryBackoff(%v, %v, %d) = %v, want %v", c.backoff, c.max, c.failures, got, c.want)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	cfg := config.DefaultCollectorConfig
+	cfg.MaxRetries = 3
+	cfg.RetryBackoff = time.Minute
+	cfg.MaxRetryBackoff = 3 * time.Minute
+	c := &collector{name: "list", config: cfg, registrar: map[string]map[string]*fileState{}}
+
+	collected := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	modTime := collected.Add(time.Hour)
+	c.setState("/data/list", "1.list", &fileState{CollectedTime: collected, ModTime: collected})
+
+	now := collected.Add(2 * time.Hour)
+	for i, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		c.recordFailure("/data/list", "1.list", c.state("/data/list", "1.list"), errors.New("permission denied"), now)
+		state := c.state("/data/list", "1.list")
+		if state.Failures != i+1 || state.NextRetry == nil || !state.NextRetry.Equal(now.Add(backoff)) {
+			t.Fatalf("failure %d: state = %+v", i+1, state)
+		}
+		if !state.CollectedTime.Equal(collected) || state.LastError != "permission denied" {
+			t.Errorf("failure %d: previous state not kept: %+v", i+1, state)
+		}
+		if c.shouldCollect(state, modTime, now.Add(backoff-time.Second)) {
+			t.Errorf("failure %d: retried before the backoff", i+1)
+		}
+		now = now.Add(backoff)
+		if !c.shouldCollect(state, modTime, now) {
+			t.Errorf("failure %d: not retried after the backoff", i+1)
+		}
+	}
+
+	// 超过 max_retries 后被隔离, 只有再次修改后才重试
+	c.recordFailure("/data/list", "1.list", c.state("/data/list", "1.list"), errors.New("permission denied"), now)
+	state := c.state("/data/list", "1.list")
+	if state.Quarantined == nil || state.NextRetry != nil {
+		t.Fatalf("state = %+v, want quarantined", state)
+	}
+	if c.shouldCollect(state, modTime, now.Add(24*time.Hour)) {
+		t.Error("quarantined file retried without being modified")
+	}
+	if !c.shouldCollect(state, now.Add(time.Second), now.Add(time.Minute)) {
+		t.Error("quarantined file not retried after being modified")
+	}
+}
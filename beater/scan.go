@@ -0,0 +1,143 @@
+package beater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// scan 中对文件的判断
+const (
+	scanNew       = "new"       // 没有采集过
+	scanModified  = "modified"  // 采集之后被修改过, 或者到了重试的时间
+	scanUnchanged = "unchanged" // 没有变化, 不会采集
+	scanExcluded  = "excluded"  // 暂时不会采集, 原因见 reason
+	scanTooLarge  = "too-large" // 超过 max_bytes, 不会发送内容
+)
+
+// ScanResult 是一次 scan 的结果, 不会发送事件也不会修改 registrar
+type ScanResult struct {
+	Directories []ScanDirectory `json:"directories"`
+	// 每种判断的文件数
+	Totals map[string]int `json:"totals"`
+	// 查找目录时遇到的错误
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ScanDirectory 是某个采集器查找到的一个目录
+type ScanDirectory struct {
+	Collector string     `json:"collector"`
+	Path      string     `json:"path"`
+	Files     []ScanFile `json:"files"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ScanFile 是目录中的一个文件以及对它的判断
+type ScanFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modtime"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Scan 查找所有的目录, 并按照 Run 中相同的逻辑判断每个文件是否会被采集
+func Scan(cfg *common.Config) (*ScanResult, error) {
+	c, err := unpackConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	bt := &lsbeat{config: c}
+	result := &ScanResult{Totals: map[string]int{}}
+	now := time.Now()
+	specs, err := allCollectorSpecs(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		registrar, err := loadRegistrarFile(spec.registrar)
+		if err != nil {
+			return nil, err
+		}
+		col := &collector{
+			name:      spec.name,
+			dirName:   spec.dirName,
+			ext:       spec.ext,
+			paths:     spec.paths,
+			config:    spec.config,
+			registrar: registrar,
+			pending:   map[string]pendingFile{},
+		}
+
+		dirs := findDirectories(context.Background(), col.paths, col.dirName, c.Shard, func(path string, err error) {
+			result.Errors = append(result.Errors, err.Error())
+		})
+		for _, dir := range dirs {
+			d := bt.scanDirectory(col, dir, now)
+			for _, f := range d.Files {
+				result.Totals[f.Decision]++
+			}
+			result.Directories = append(result.Directories, d)
+		}
+	}
+	return result, nil
+}
+
+func (bt *lsbeat) scanDirectory(c *collector, dir string, now time.Time) ScanDirectory {
+	d := ScanDirectory{Collector: c.name, Path: dir, Files: []ScanFile{}}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		f := ScanFile{Name: file.Name()}
+		info, err := file.Info()
+		if err != nil {
+			f.Decision, f.Reason = scanExcluded, err.Error()
+			d.Files = append(d.Files, f)
+			continue
+		}
+		f.Size, f.ModTime = info.Size(), info.ModTime()
+		f.Decision, f.Reason = bt.scanDecision(c, dir, info, now)
+		d.Files = append(d.Files, f)
+	}
+	return d
+}
+
+// scanDecision 和 collect 中的判断保持一致
+func (bt *lsbeat) scanDecision(c *collector, dir string, info os.FileInfo, now time.Time) (string, string) {
+	if filepath.Ext(info.Name()) != c.ext {
+		return scanExcluded, "not a " + c.ext + " file"
+	}
+
+	state := c.state(dir, info.Name())
+	if !c.shouldCollect(state, info.ModTime(), now) {
+		switch {
+		case state.Quarantined != nil:
+			return scanExcluded, "quarantined"
+		case state.NextRetry != nil:
+			return scanExcluded, "retry at " + state.NextRetry.Format(time.RFC3339)
+		}
+		return scanUnchanged, ""
+	}
+	if reason := bt.writePending(c, dir, info, now); reason != "" {
+		return scanExcluded, reason
+	}
+	if c.tooLarge(info) {
+		return scanTooLarge, fmt.Sprintf("size exceeds max_bytes %d", c.config.MaxBytes)
+	}
+	if state == nil || state.CollectedTime.IsZero() {
+		return scanNew, ""
+	}
+	return scanModified, ""
+}
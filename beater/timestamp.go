@@ -0,0 +1,89 @@
+package beater
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+// @timestamp 的来源
+const (
+	timestampCollected = "collected" // 采集时间
+	timestampMtime     = "mtime"     // 文件的修改时间
+	timestampFilename  = "filename"  // 从文件名中解析
+	timestampContent   = "content"   // 从文件内容中解析
+)
+
+// fileTimestamp 根据 timestamp_source 得到事件的 @timestamp
+type fileTimestamp struct {
+	source  string
+	pattern *regexp.Regexp
+	layouts []string
+}
+
+func newFileTimestamp(c config.CollectorConfig) (*fileTimestamp, error) {
+	ft := &fileTimestamp{source: c.TimestampSource, layouts: defaultTimestampLayouts}
+	if c.TimestampLayout != "" {
+		ft.layouts = []string{c.TimestampLayout}
+	}
+
+	switch c.TimestampSource {
+	case "", timestampCollected:
+		ft.source = timestampCollected
+	case timestampMtime:
+	case timestampFilename, timestampContent:
+		pattern := c.TimestampPattern
+		if pattern == "" && c.TimestampSource == timestampContent {
+			pattern = patternLibrary["TIMESTAMP_ISO8601"]
+		}
+		if pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp_pattern: %v", err)
+			}
+			ft.pattern = re
+		}
+	default:
+		return nil, fmt.Errorf("unsupported timestamp_source '%s'", c.TimestampSource)
+	}
+	return ft, nil
+}
+
+// timestamp 返回文件对应的时间, 解析失败时返回错误, 由调用方回退到采集时间
+func (ft *fileTimestamp) timestamp(filename string, modtime time.Time, content string, now time.Time) (time.Time, error) {
+	switch ft.source {
+	case timestampMtime:
+		return modtime, nil
+	case timestampFilename:
+		// 没有 pattern 时整个文件名 (去掉后缀) 就是时间
+		value := strings.TrimSuffix(filename, filepath.Ext(filename))
+		return ft.parse(value)
+	case timestampContent:
+		return ft.parse(content)
+	}
+	return now, nil
+}
+
+func (ft *fileTimestamp) parse(value string) (time.Time, error) {
+	if ft.pattern != nil {
+		m := ft.pattern.FindStringSubmatch(value)
+		if m == nil {
+			return time.Time{}, fmt.Errorf("timestamp_pattern does not match")
+		}
+		// 有捕获组时取第一个捕获组, 否则取整个匹配
+		value = m[0]
+		if len(m) > 1 {
+			value = m[1]
+		}
+	}
+	// 文件名和内容中的数字 (比如 20231226) 不作为 unix 时间戳
+	ts, ok := parseTimestampLayouts(value, ft.layouts)
+	if !ok {
+		return time.Time{}, fmt.Errorf("can not parse timestamp '%s'", value)
+	}
+	return ts, nil
+}
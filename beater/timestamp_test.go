@@ -0,0 +1,101 @@
+//go:build !integration
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Qiu-Weidong/lsbeat/config"
+)
+
+func TestFileTimestamp(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name     string
+		config   config.CollectorConfig
+		filename string
+		content  string
+		ts       time.Time
+		fail     bool
+	}{
+		{
+			name:     "collected",
+			config:   config.CollectorConfig{TimestampSource: "collected"},
+			filename: "1.list",
+			ts:       now,
+		},
+		{
+			name:     "mtime",
+			config:   config.CollectorConfig{TimestampSource: "mtime"},
+			filename: "1.list",
+			ts:       modtime,
+		},
+		{
+			name:     "filename with layout",
+			config:   config.CollectorConfig{TimestampSource: "filename", TimestampLayout: "20060102"},
+			filename: "20231226.list",
+			ts:       time.Date(2023, 12, 26, 0, 0, 0, 0, time.Local),
+		},
+		{
+			name:     "filename with pattern",
+			config:   config.CollectorConfig{TimestampSource: "filename", TimestampLayout: "20060102-1504", TimestampPattern: `job-(\d{8}-\d{4})`},
+			filename: "job-20231226-0737.list",
+			ts:       time.Date(2023, 12, 26, 7, 37, 0, 0, time.Local),
+		},
+		{
+			// 数字不能被当作 unix 时间戳 (1970-08-23)
+			name:     "filename number without layout",
+			config:   config.CollectorConfig{TimestampSource: "filename"},
+			filename: "20231226.list",
+			fail:     true,
+		},
+		{
+			name:     "filename layout does not match",
+			config:   config.CollectorConfig{TimestampSource: "filename", TimestampLayout: "2006-01-02"},
+			filename: "20231226.list",
+			fail:     true,
+		},
+		{
+			name:     "filename pattern does not match",
+			config:   config.CollectorConfig{TimestampSource: "filename", TimestampLayout: "20060102", TimestampPattern: `job-(\d{8})`},
+			filename: "20231226.list",
+			fail:     true,
+		},
+		{
+			name:     "content",
+			config:   config.CollectorConfig{TimestampSource: "content"},
+			filename: "1.log",
+			content:  "started at 2023-12-26T07:37:05Z\nok\n",
+			ts:       time.Date(2023, 12, 26, 7, 37, 5, 0, time.UTC),
+		},
+		{
+			name:     "content number",
+			config:   config.CollectorConfig{TimestampSource: "content", TimestampPattern: `\d+`},
+			filename: "1.log",
+			content:  "1700000000\n",
+			fail:     true,
+		},
+	}
+
+	for _, c := range cases {
+		ft, err := newFileTimestamp(c.config)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		ts, err := ft.timestamp(c.filename, modtime, c.content, now)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: timestamp = %v, want an error", c.name, ts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !ts.Equal(c.ts) {
+			t.Errorf("%s: timestamp = %v, want %v", c.name, ts, c.ts)
+		}
+	}
+}
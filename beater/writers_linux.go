@@ -0,0 +1,66 @@
+package beater
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// openWriters 遍历 /proc/<pid>/fd, 找出所有被以写方式打开的文件.
+// 没有权限查看的进程会被忽略.
+func openWriters() (map[string]bool, error) {
+	writers := map[string]bool{}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return writers, err
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil || proc.Name() == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "/") {
+				continue
+			}
+			if openedForWrite(filepath.Join("/proc", proc.Name(), "fdinfo", fd.Name())) {
+				writers[target] = true
+			}
+		}
+	}
+	return writers, nil
+}
+
+// 读取 fdinfo 中的 flags 判断打开方式
+func openedForWrite(fdinfo string) bool {
+	f, err := os.Open(fdinfo)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), 8, 64)
+		if err != nil {
+			return false
+		}
+		mode := flags & syscall.O_ACCMODE
+		return mode == syscall.O_WRONLY || mode == syscall.O_RDWR
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package beater
+
+import "errors"
+
+func openWriters() (map[string]bool, error) {
+	return map[string]bool{}, errors.New("ignore_open_files is only supported on linux")
+}
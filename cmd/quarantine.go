@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+
+	"github.com/Qiu-Weidong/lsbeat/beater"
+)
+
+// 读取 lsbeat 部分的配置
+func beatConfig(settings instance.Settings) (*common.Config, error) {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing beat: %s", err)
+	}
+	return b.BeatConfig()
+}
+
+// genQuarantineCmd 生成 quarantine 命令, 用于查看和恢复多次采集失败被隔离的文件
+func genQuarantineCmd(settings instance.Settings) *cobra.Command {
+	quarantineCmd := &cobra.Command{
+		Use:   "quarantine",
+		Short: "Manage files quarantined after repeated collection failures",
+	}
+
+	quarantineCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List quarantined files",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			files, err := beater.ListQuarantined(cfg)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "COLLECTOR\tPATH\tFAILURES\tQUARANTINED\tLAST ERROR")
+			for _, f := range files {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", f.Collector, f.Path, f.Failures, f.Quarantined.Format(time.RFC3339), f.LastError)
+			}
+			return w.Flush()
+		}),
+	})
+
+	var all bool
+	clearCmd := &cobra.Command{
+		Use:   "clear [path...]",
+		Short: "Clear the quarantine so that files are retried on the next cycle",
+		Long: "Clear the quarantine of the given files, or of all files with --all.\n" +
+			"lsbeat must be stopped, otherwise the running beat would overwrite the change.",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && !all {
+				return fmt.Errorf("no path given, use --all to clear all quarantined files")
+			}
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			n, err := beater.ClearQuarantined(cfg, args)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d files cleared\n", n)
+			return nil
+		}),
+	}
+	clearCmd.Flags().BoolVar(&all, "all", false, "clear all quarantined files")
+	quarantineCmd.AddCommand(clearCmd)
+
+	return quarantineCmd
+}
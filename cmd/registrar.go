@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+
+	"github.com/Qiu-Weidong/lsbeat/beater"
+)
+
+// genRegistrarCmd 生成 registrar 命令, 用于查看和修改文件的采集状态
+func genRegistrarCmd(settings instance.Settings) *cobra.Command {
+	var collector string
+	registrarCmd := &cobra.Command{
+		Use:   "registrar",
+		Short: "Inspect and edit the state of collected files",
+		Long: "Inspect and edit the state of collected files.\n" +
+			"Commands that modify the registrar refuse to run while lsbeat is running.",
+	}
+	registrarCmd.PersistentFlags().StringVar(&collector, "collector", "", "only the given collector, list, log or one defined in lsbeat.d")
+
+	var prefix string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the files in the registrar",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			entries, err := beater.ListRegistrar(cfg, collector, prefix)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "COLLECTOR\tPATH\tCOLLECTED\tSIZE\tSTATUS")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", e.Collector, e.Path, formatTime(e.CollectedTime), e.Size, e.Status())
+			}
+			return w.Flush()
+		}),
+	}
+	listCmd.Flags().StringVar(&prefix, "prefix", "", "only files whose path starts with this prefix")
+	registrarCmd.AddCommand(listCmd)
+
+	registrarCmd.AddCommand(&cobra.Command{
+		Use:   "show <file>",
+		Short: "Show the registrar state of a file",
+		Args:  cobra.ExactArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			path, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			entries, err := beater.ListRegistrar(cfg, collector, path)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for _, e := range entries {
+				if e.Path != path && e.Path != args[0] {
+					continue
+				}
+				found = true
+				state, err := json.MarshalIndent(e, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s\nstatus: %s\n", state, e.Status())
+			}
+			if !found {
+				return fmt.Errorf("%s is not in the registrar, it has not been collected yet", args[0])
+			}
+			return nil
+		}),
+	})
+
+	registrarCmd.AddCommand(&cobra.Command{
+		Use:   "forget <path-or-glob>...",
+		Short: "Remove files from the registrar so that they are collected again",
+		Long: "Remove files from the registrar so that they are collected again.\n" +
+			"Each argument is a file, a directory or a glob matched against the full path.",
+		Args: cobra.MinimumNArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			n, err := beater.ForgetRegistrar(cfg, collector, args)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d files forgotten\n", n)
+			return nil
+		}),
+	})
+
+	var yes bool
+	resetCmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Remove all files from the registrar, everything is collected again",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			if !yes {
+				return fmt.Errorf("all files would be collected again, pass --yes to confirm")
+			}
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			n, err := beater.ResetRegistrar(cfg, collector)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d files removed\n", n)
+			return nil
+		}),
+	}
+	resetCmd.Flags().BoolVar(&yes, "yes", false, "confirm the reset")
+	registrarCmd.AddCommand(resetCmd)
+
+	registrarCmd.AddCommand(&cobra.Command{
+		Use:   "export [file]",
+		Short: "Export the registrar as JSON, to stdout if no file is given",
+		Args:  cobra.MaximumNArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				return beater.ExportRegistrar(cfg, collector, os.Stdout)
+			}
+
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			if err := beater.ExportRegistrar(cfg, collector, f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}),
+	})
+
+	var replace bool
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Import a registrar exported with 'registrar export', from stdin if no file is given",
+		Args:  cobra.MaximumNArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			var r io.Reader = os.Stdin
+			if len(args) > 0 {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			n, err := beater.ImportRegistrar(cfg, collector, r, replace)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d files imported\n", n)
+			return nil
+		}),
+	}
+	importCmd.Flags().BoolVar(&replace, "replace", false, "remove the existing entries before importing")
+	registrarCmd.AddCommand(importCmd)
+
+	registrarCmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Show statistics of the registrar",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			stats, err := beater.GetRegistrarStats(cfg)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "COLLECTOR\tDIRECTORIES\tFILES\tSKIPPED\tFAILING\tQUARANTINED\tOLDEST\tNEWEST\tREGISTRAR")
+			for _, s := range stats {
+				if collector != "" && s.Collector != collector {
+					continue
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", s.Collector, s.Directories, s.Files,
+					s.Skipped, s.Failing, s.Quarantined, formatTime(s.Oldest), formatTime(s.Newest), s.Path)
+			}
+			return w.Flush()
+		}),
+	})
+
+	return registrarCmd
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
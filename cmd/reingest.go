@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+
+	"github.com/Qiu-Weidong/lsbeat/beater"
+)
+
+// --since 和 --until 支持的时间格式, 没有时区时使用本地时间
+var reingestTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// genReingestCmd 生成 reingest 命令, 按时间范围和路径重新发送已经采集过的文件
+func genReingestCmd(settings instance.Settings) *cobra.Command {
+	var since, until string
+	var opts beater.ReingestOptions
+	reingestCmd := &cobra.Command{
+		Use:   "reingest",
+		Short: "Publish matching files again, e.g. after fixing an ingest pipeline",
+		Long: "Publish the files matching the filters again with the normal collector settings.\n" +
+			"Events are tagged with event.reingest: true. lsbeat exits once they are acknowledged.",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			var err error
+			if opts.Since, err = parseReingestTime(since); err != nil {
+				return fmt.Errorf("invalid --since: %v", err)
+			}
+			if opts.Until, err = parseReingestTime(until); err != nil {
+				return fmt.Errorf("invalid --until: %v", err)
+			}
+			if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+				return fmt.Errorf("--since must be before --until")
+			}
+			return instance.Run(settings, beater.NewReingest(opts))
+		}),
+	}
+	reingestCmd.Flags().StringVar(&since, "since", "", "only files modified at or after this time (RFC3339 or 2006-01-02)")
+	reingestCmd.Flags().StringVar(&until, "until", "", "only files modified before this time (RFC3339 or 2006-01-02)")
+	reingestCmd.Flags().StringVar(&opts.PathGlob, "path-glob", "", "only files whose path or one of its parent directories matches this glob")
+	reingestCmd.Flags().StringVar(&opts.Collector, "collector", "", "only the given collector, list, log or one defined in lsbeat.d")
+	reingestCmd.Flags().BoolVar(&opts.SkipRegistrar, "skip-registrar", false, "do not update the registrar")
+	return reingestCmd
+}
+
+func parseReingestTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range reingestTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can not parse time '%s'", value)
+}
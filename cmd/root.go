@@ -1,14 +1,41 @@
 package cmd
 
 import (
+	"flag"
+
+	"github.com/spf13/pflag"
+
 	"github.com/Qiu-Weidong/lsbeat/beater"
 
 	cmd "github.com/elastic/beats/v7/libbeat/cmd"
 	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/cmd/test"
 )
 
 // Name of this beat
 var Name = "lsbeat"
 
+var settings = instance.Settings{Name: Name}
+
 // RootCmd to handle beats cli
-var RootCmd = cmd.GenRootCmdWithSettings(beater.New, instance.Settings{Name: Name})
+var RootCmd = genRootCmd()
+
+func genRootCmd() *cmd.BeatsRootCmd {
+	rootCmd := cmd.GenRootCmdWithSettings(beater.New, settings)
+	runFlags := pflag.NewFlagSet(Name, pflag.ExitOnError)
+	runFlags.AddGoFlag(flag.CommandLine.Lookup("once"))
+	rootCmd.RunCmd.Flags().AddFlagSet(runFlags)
+	rootCmd.Flags().AddFlagSet(runFlags)
+	// test config 还要检查根目录和 registrar 目录
+	for _, c := range rootCmd.TestCmd.Commands() {
+		if c.Name() == "config" {
+			rootCmd.TestCmd.RemoveCommand(c)
+		}
+	}
+	rootCmd.TestCmd.AddCommand(test.GenTestConfigCmd(settings, beater.NewTestConfig))
+	rootCmd.AddCommand(genQuarantineCmd(settings))
+	rootCmd.AddCommand(genRegistrarCmd(settings))
+	rootCmd.AddCommand(genScanCmd(settings))
+	rootCmd.AddCommand(genReingestCmd(settings))
+	return rootCmd
+}
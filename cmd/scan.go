@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+
+	"github.com/Qiu-Weidong/lsbeat/beater"
+)
+
+// genScanCmd 生成 scan 命令, 预览当前配置下会采集哪些文件
+func genScanCmd(settings instance.Settings) *cobra.Command {
+	var dryRun bool
+	var output string
+	scanCmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Preview which files would be collected with the current configuration",
+		Long: "Discover the directories and decide for each file whether it would be collected,\n" +
+			"without publishing events or writing the registrar.",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			if !dryRun {
+				return fmt.Errorf("only --dry-run is supported, run lsbeat to collect the files")
+			}
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unsupported output '%s', use table or json", output)
+			}
+			cfg, err := beatConfig(settings)
+			if err != nil {
+				return err
+			}
+			result, err := beater.Scan(cfg)
+			if err != nil {
+				return err
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(result)
+			}
+			return printScan(result)
+		}),
+	}
+	scanCmd.Flags().BoolVar(&dryRun, "dry-run", false, "do not publish events or write the registrar")
+	scanCmd.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+	return scanCmd
+}
+
+func printScan(result *beater.ScanResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, d := range result.Directories {
+		if d.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\n", d.Collector, d.Path, d.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d files\n", d.Collector, d.Path, len(d.Files))
+		for _, f := range d.Files {
+			fmt.Fprintf(w, "\t  %s\t%s\t%d\t%s\n", filepath.Join(d.Path, f.Name), f.Decision, f.Size, f.Reason)
+		}
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(w, "error\t%s\n", e)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	decisions := make([]string, 0, len(result.Totals))
+	for d := range result.Totals {
+		decisions = append(decisions, d)
+	}
+	sort.Strings(decisions)
+	fmt.Printf("\n%d directories", len(result.Directories))
+	for _, d := range decisions {
+		fmt.Printf(", %d %s", result.Totals[d], d)
+	}
+	fmt.Println()
+	return nil
+}
@@ -3,21 +3,201 @@
 
 package config
 
-import "time"
+import (
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cfgtype"
+	"github.com/elastic/beats/v7/libbeat/common/fmtstr"
+	"github.com/elastic/beats/v7/libbeat/processors"
+)
 
 type Config struct {
 	Period time.Duration `config:"period"`
 	Cycles int           `config:"cycles"`
 
+	// 只采集一遍, 等待所有事件被确认后退出, 和命令行参数 --once 相同
+	RunOnce bool `config:"run_once"`
+
+	// 停止时等待已发送事件被确认的最长时间, 0 表示不等待
+	ShutdownTimeout time.Duration `config:"shutdown_timeout"`
+
+	// registrar 的存储方式: json 或 memlog
+	RegistrarBackend  string   `config:"registrar_backend"`
 	RegistrarListPath string   `config:"registrar_list_path"`
 	RegistrarLogPath  string   `config:"registrar_log_path"`
-	Path              []string `config: "path"`
+	Path              []string `config:"path"`
+
+	// 读取 registrar 时替换路径的前缀, 数据盘挂载到新的位置后不需要重新采集
+	PathRewrite []PathRewrite `config:"path_rewrite"`
+
+	// 多个 lsbeat 分担同一个根目录, 每个只采集分配给自己的目录
+	Shard ShardConfig `config:"shard"`
+
+	List CollectorConfig `config:"list"`
+	Log  CollectorConfig `config:"log"`
+
+	// lsbeat.d/*.yml 中定义的其他采集器, 和 filebeat 的 config.inputs 一样可以动态加载
+	Collectors *common.Config `config:"config.collectors"`
+}
+
+// PathRewrite 把以 From 开头的路径替换为以 To 开头
+type PathRewrite struct {
+	From string `config:"from"`
+	To   string `config:"to"`
+}
+
+// ShardConfig 把查找到的目录按照相对于根目录的路径的哈希分配给 count 个实例
+type ShardConfig struct {
+	Count int `config:"count"`
+	Index int `config:"index"`
+}
+
+// CollectorDefinition 是 lsbeat.d/*.yml 中定义的一个采集器
+type CollectorDefinition struct {
+	// 采集器的名字, 也是事件中的 type 字段, 不能是 list 或 log
+	Name string `config:"name"`
+	// 需要查找的目录名以及需要采集的文件后缀
+	DirName string `config:"dir_name"`
+	Ext     string `config:"ext"`
+	// 查找的根目录, 为空时使用 lsbeat.path
+	Path []string `config:"path"`
+	// registrar 的位置, 为空时和 list 的 registrar 放在一起, 文件名为 registrar-<name>.json
+	RegistrarPath string `config:"registrar_path"`
+	// 由 libbeat 的 reloader 使用
+	Enabled bool `config:"enabled"`
+
+	CollectorConfig `config:",inline"`
+}
+
+// CollectorConfig 是 list / log 采集器各自的配置
+type CollectorConfig struct {
+	// 文件的字符编码, 发送前统一转换为 UTF-8
+	// 可选 utf-8, gbk, gb18030, utf-16le, utf-16be, latin1, auto
+	Encoding string `config:"encoding"`
+
+	// 二进制文件的处理方式: skip, base64, metadata
+	BinaryPolicy string `config:"binary_policy"`
+	// 文件开头不可打印字符所占比例超过该值时视为二进制文件
+	BinaryThreshold float64 `config:"binary_threshold"`
+
+	// 超过这个大小的文件不读取, 只在 registrar 中记录为 too-large, 0 表示不限制.
+	// 每个文件是一个事件, 太大的文件会被 output 拒绝
+	MaxBytes cfgtype.ByteSize `config:"max_bytes"`
+
+	// 文件的大小和修改时间保持不变超过这段时间后才采集, 0 表示不等待
+	CloseWriteGrace time.Duration `config:"close_write_grace"`
+	// 设置后只有存在对应的标记文件 (比如 x.list.done) 时才采集 x.list
+	DoneSuffix string `config:"done_suffix"`
+	// 跳过仍被其他进程以写方式打开的文件, 仅支持 Linux
+	IgnoreOpenFiles bool `config:"ignore_open_files"`
+
+	// 设置后按行解析文件内容, 每行发送一个事件
+	Parser ParserConfig `config:"parser"`
+
+	// @timestamp 的来源: collected, mtime, filename, content
+	TimestampSource string `config:"timestamp_source"`
+	// 从文件名或内容中解析时间时使用的格式 (Go 的时间格式)
+	TimestampLayout string `config:"timestamp_layout"`
+	// 从文件名或内容中提取时间的正则表达式, 有捕获组时取第一个捕获组
+	TimestampPattern string `config:"timestamp_pattern"`
+
+	// 文件被删除或重命名时发送 event.action 为 deleted / renamed 的事件
+	LifecycleEvents bool `config:"lifecycle_events"`
+
+	// 文件被修改时发送和上一次采集的内容之间的差异
+	Diff DiffConfig `config:"diff"`
+
+	// 根据文件和内容生成固定的 @metadata._id, 重复采集时覆盖而不是重复
+	DocumentID bool `config:"document_id"`
+
+	// 目录或文件读取失败时发送 event.kind 为 pipeline_error 的事件
+	ErrorEvents bool `config:"error_events"`
+
+	// 读取失败的文件按指数退避重试, 超过 max_retries 次后被隔离
+	MaxRetries      int           `config:"max_retries"`
+	RetryBackoff    time.Duration `config:"retry_backoff"`
+	MaxRetryBackoff time.Duration `config:"max_retry_backoff"`
+
+	// 文件的所有事件都被 output 确认后对文件执行的动作
+	AfterCollect AfterCollectConfig `config:"after_collect"`
+
+	// 发送到 publisher pipeline 时的设置, 和 filebeat 的 input 一样
+	common.EventMetadata `config:",inline"`       // fields, fields_under_root, tags
+	Processors           processors.PluginConfig  `config:"processors"`
+	KeepNull             bool                     `config:"keep_null"`
+	Pipeline             string                   `config:"pipeline"` // Elasticsearch 的 ingest pipeline
+	Index                fmtstr.EventFormatString `config:"index"`    // Elasticsearch 的索引
+}
+
+// AfterCollectConfig 是采集完成后对文件的处理
+type AfterCollectConfig struct {
+	// none, delete, move 或 rename
+	Action string `config:"action"`
+	// move 的目标目录, 保持文件相对于根目录的结构
+	MoveTo string `config:"move_to"`
+	// rename 时添加的后缀
+	RenameSuffix string `config:"rename_suffix"`
+}
+
+// DiffConfig 是内容差异的配置
+type DiffConfig struct {
+	// lines 或 unified, 为空表示不计算差异
+	Mode string `config:"mode"`
+	// 是否仍然发送完整的内容
+	Content bool `config:"content"`
+	// unified diff 中每处变化前后保留的行数
+	Context int `config:"context"`
+}
+
+// ParserConfig 是按行解析的配置
+type ParserConfig struct {
+	// ndjson, logfmt 或 pattern, 为空表示不解析
+	Type string `config:"type"`
+	// 解析出的字段放到这个字段下面, 为空表示放到事件的顶层
+	Target string `config:"target"`
+	// 放到顶层时是否覆盖已有的字段
+	OverwriteKeys bool `config:"overwrite_keys"`
+	// pattern 使用的正则表达式, 可以用 %{NAME:field} 引用内置的模式
+	Pattern string `config:"pattern"`
+
+	// 记录自身时间戳所在的字段以及格式
+	TimestampField   string   `config:"timestamp_field"`
+	TimestampLayouts []string `config:"timestamp_layouts"`
+}
+
+var DefaultCollectorConfig = CollectorConfig{
+	Encoding:        "utf-8",
+	BinaryPolicy:    "skip",
+	BinaryThreshold: 0.3,
+	TimestampSource: "collected",
+	DocumentID:      true,
+	MaxRetries:      5,
+	RetryBackoff:    time.Minute,
+	MaxRetryBackoff: time.Hour,
+	AfterCollect: AfterCollectConfig{
+		Action: "none",
+	},
+	Diff: DiffConfig{
+		Content: true,
+		Context: 3,
+	},
+}
+
+var DefaultCollectorDefinition = CollectorDefinition{
+	Enabled:         true,
+	CollectorConfig: DefaultCollectorConfig,
 }
 
 var DefaultConfig = Config{
 	Period:            10 * time.Second,
+	RegistrarBackend:  "json",
 	RegistrarListPath: "./data/registrar",
 	RegistrarLogPath:  "./data/registrar",
 	Path:              []string{},
 	Cycles:            8,
+	Shard:             ShardConfig{Count: 1},
+
+	List: DefaultCollectorConfig,
+	Log:  DefaultCollectorConfig,
 }
@@ -2,3 +2,120 @@
 // +build !integration
 
 package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestCheckUnknownKeys(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"period": "10s",
+		"paths":  []string{"/data"},
+		"list": map[string]interface{}{
+			"encoding":   "gbk",
+			"fields":     map[string]interface{}{"anything": 1},
+			"tags":       []string{"a"},
+			"processors": []interface{}{map[string]interface{}{"drop_fields": map[string]interface{}{"fields": []string{"x"}}}},
+			"diff":       map[string]interface{}{"mode": "lines", "contxt": 2},
+		},
+	})
+
+	err := CheckUnknownKeys(cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, key := range []string{"'paths'", "'list.diff.contxt'"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not mention %s", err, key)
+		}
+	}
+	if strings.Contains(err.Error(), "anything") || strings.Contains(err.Error(), "drop_fields") {
+		t.Errorf("free-form settings reported: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	c := DefaultConfig
+	c.Path = []string{dir, dir + "/missing"}
+	c.RegistrarListPath = dir + "/registrar"
+	c.RegistrarLogPath = dir + "/registrar/registrar-log.json"
+	c.Period = 0
+	c.Shard = ShardConfig{Count: 4, Index: 4}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, msg := range []string{"period must be positive", "shard.index"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q does not mention %s", err, msg)
+		}
+	}
+	// 文件系统在启动采集器时才检查
+	if strings.Contains(err.Error(), "missing") || strings.Contains(err.Error(), "registrar") {
+		t.Errorf("filesystem checked by Validate: %v", err)
+	}
+	if _, err := os.Stat(dir + "/registrar"); !os.IsNotExist(err) {
+		t.Errorf("registrar directory created by Validate: %v", err)
+	}
+
+	if err := CheckReadableDir(dir + "/missing"); err == nil {
+		t.Error("missing root is readable")
+	}
+	// lsbeat test config 只检查, 不创建目录
+	if err := CheckWritableDir(dir+"/registrar/data", false); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(dir + "/registrar"); !os.IsNotExist(err) {
+		t.Errorf("registrar directory created by a check: %v", err)
+	}
+	if err := CheckWritableDir(dir+"/registrar", true); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(dir + "/registrar"); err != nil {
+		t.Error(err)
+	}
+	if err := os.WriteFile(dir+"/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWritableDir(dir+"/file/registrar", false); err == nil {
+		t.Error("registrar directory under a file is writable")
+	}
+}
+
+// 随 lsbeat 发布的配置文件都要能通过检查
+func TestShippedConfigs(t *testing.T) {
+	for _, path := range []string{
+		"../lsbeat.yml",
+		"../lsbeat.docker.yml",
+		"../lsbeat.reference.yml",
+		"../_meta/config/beat.yml.tmpl",
+		"../_meta/config/beat.docker.yml.tmpl",
+		"../_meta/config/beat.reference.yml.tmpl",
+	} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := common.NewConfigWithYAML(content, path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		sub, err := cfg.Child("lsbeat", -1)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if err := CheckUnknownKeys(sub); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		c := DefaultConfig
+		if err := sub.Unpack(&c); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// Validate 检查配置的取值, go-ucfg 在 Unpack 之后自动调用
+func (c *Config) Validate() error {
+	var errs []string
+	if c.Period <= 0 {
+		errs = append(errs, fmt.Sprintf("period must be positive, got %v", c.Period))
+	}
+	if c.Cycles < 1 {
+		errs = append(errs, fmt.Sprintf("cycles must be at least 1, got %d", c.Cycles))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("shutdown_timeout must not be negative, got %v", c.ShutdownTimeout))
+	}
+	errs = append(errs, c.List.validate("list.")...)
+	errs = append(errs, c.Log.validate("log.")...)
+
+	// 根目录是否可读, registrar 目录是否可写在启动采集器和 lsbeat test config 时检查, registrar 和 scan 等命令
+	// 也会读取配置, 不能因为根目录暂时没有挂载而失败, 也不应该创建目录
+	if len(c.Path) == 0 {
+		errs = append(errs, "path must contain at least one directory")
+	}
+
+	if c.Shard.Count < 1 {
+		errs = append(errs, fmt.Sprintf("shard.count must be at least 1, got %d", c.Shard.Count))
+	} else if c.Shard.Index < 0 || c.Shard.Index >= c.Shard.Count {
+		errs = append(errs, fmt.Sprintf("shard.index must be between 0 and %d, got %d", c.Shard.Count-1, c.Shard.Index))
+	}
+	for i, r := range c.PathRewrite {
+		if !filepath.IsAbs(r.From) || !filepath.IsAbs(r.To) {
+			errs = append(errs, fmt.Sprintf("path_rewrite.%d: from and to must be absolute paths, got '%s' and '%s'", i, r.From, r.To))
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+// validate 检查采集器中和其他配置无关的取值, 编码等名称在创建采集器时检查.
+// 不使用 Validate 这个名字, 否则 go-ucfg 会单独调用它, 出错时就看不到其他的错误了.
+func (c *CollectorConfig) validate(prefix string) []string {
+	var errs []string
+	if c.BinaryThreshold < 0 || c.BinaryThreshold > 1 {
+		errs = append(errs, fmt.Sprintf("%sbinary_threshold must be between 0 and 1, got %v", prefix, c.BinaryThreshold))
+	}
+	if c.CloseWriteGrace < 0 {
+		errs = append(errs, fmt.Sprintf("%sclose_write_grace must not be negative, got %v", prefix, c.CloseWriteGrace))
+	}
+	if c.Diff.Context < 0 {
+		errs = append(errs, fmt.Sprintf("%sdiff.context must not be negative, got %d", prefix, c.Diff.Context))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, fmt.Sprintf("%smax_retries must not be negative, got %d", prefix, c.MaxRetries))
+	}
+	if c.RetryBackoff <= 0 {
+		errs = append(errs, fmt.Sprintf("%sretry_backoff must be positive, got %v", prefix, c.RetryBackoff))
+	}
+	if c.MaxRetryBackoff < c.RetryBackoff {
+		errs = append(errs, fmt.Sprintf("%smax_retry_backoff (%v) must not be less than retry_backoff (%v)", prefix, c.MaxRetryBackoff, c.RetryBackoff))
+	}
+	return errs
+}
+
+// CheckReadableDir 检查 path 是一个可以列出内容的目录
+func CheckReadableDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// CheckWritableDir 检查目录是否可写: 目录不存在时创建它, 然后写入一个临时文件.
+// create 为 false 时不创建目录, 目录不存在时检查能否在最近的上级目录中创建它.
+func CheckWritableDir(dir string, create bool) error {
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	} else {
+		for {
+			info, err := os.Stat(dir)
+			if err == nil {
+				if !info.IsDir() {
+					return fmt.Errorf("%s is not a directory", dir)
+				}
+				break
+			}
+			parent := filepath.Dir(dir)
+			if !os.IsNotExist(err) || parent == dir {
+				return err
+			}
+			dir = parent
+		}
+	}
+	f, err := os.CreateTemp(dir, ".lsbeat-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// 采集器的名字会用在文件名中
+var collectorName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate 检查 lsbeat.d 中采集器的定义
+func (d *CollectorDefinition) Validate() error {
+	var errs []string
+	switch {
+	case d.Name == "":
+		errs = append(errs, "name is required")
+	case d.Name == "list" || d.Name == "log":
+		errs = append(errs, fmt.Sprintf("name '%s' is reserved for the built-in collector", d.Name))
+	case !collectorName.MatchString(d.Name):
+		errs = append(errs, fmt.Sprintf("name '%s' may only contain letters, digits, '_' and '-'", d.Name))
+	}
+	if d.DirName == "" {
+		errs = append(errs, "dir_name is required")
+	}
+	if !strings.HasPrefix(d.Ext, ".") {
+		errs = append(errs, fmt.Sprintf("ext must start with '.', got '%s'", d.Ext))
+	}
+	errs = append(errs, d.CollectorConfig.validate("")...)
+	return joinErrors(errs)
+}
+
+// CheckUnknownKeys 检查 lsbeat 部分的配置中是否有无法识别的配置项, 一般是拼写错误
+func CheckUnknownKeys(cfg *common.Config) error {
+	var errs []string
+	checkKeys(cfg, reflect.TypeOf(Config{}), "", &errs)
+	return joinErrors(errs)
+}
+
+// UnpackCollectorDefinition 读取 lsbeat.d 中的一个采集器定义, 同样拒绝无法识别的配置项
+func UnpackCollectorDefinition(cfg *common.Config) (CollectorDefinition, error) {
+	d := DefaultCollectorDefinition
+	var errs []string
+	checkKeys(cfg, reflect.TypeOf(d), "", &errs)
+	if err := cfg.Unpack(&d); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return d, joinErrors(errs)
+}
+
+func checkKeys(cfg *common.Config, t reflect.Type, prefix string, errs *[]string) {
+	known := map[string]reflect.Type{}
+	collectKeys(t, known)
+
+	for _, name := range cfg.GetFields() {
+		ft, ok := known[name]
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("unknown setting '%s%s'", prefix, name))
+			continue
+		}
+		// 只检查本包中定义的结构体, 其他的比如 processors 和 fields 可以是任意内容
+		if ft == nil {
+			continue
+		}
+		child, err := cfg.Child(name, -1)
+		if err != nil {
+			continue
+		}
+		checkKeys(child, ft, prefix+name+".", errs)
+	}
+}
+
+// collectKeys 收集结构体的所有配置项, 需要继续检查的结构体类型也一起返回
+func collectKeys(t reflect.Type, known map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("config")
+		name := strings.Split(tag, ",")[0]
+		if strings.Contains(tag, ",inline") {
+			collectKeys(f.Type, known)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if i := strings.Index(name, "."); i >= 0 {
+			// 比如 config.collectors, 只检查第一级
+			known[name[:i]] = nil
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type.PkgPath() == t.PkgPath() {
+			known[name] = f.Type
+		} else {
+			known[name] = nil
+		}
+	}
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}